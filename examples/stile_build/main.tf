@@ -0,0 +1,27 @@
+terraform {
+  required_providers {
+    stile = {
+      version = "0.2"
+      source = "hashicorp.com/edu/stile"
+    }
+  }
+}
+
+# The latest passing master build that produced the prober manifest.
+data "stile_build" "main" {
+  branch        = "master"
+  with_artifact = "untested-prober-service-manifest.json"
+}
+
+data "stile_manifest" "prober" {
+  bfp_build_number = data.stile_build.main.number
+  manifest_name    = "untested-prober-service-manifest.json"
+}
+
+output "build" {
+  value = data.stile_build.main
+}
+
+output "image" {
+  value = data.stile_manifest.prober.service_versions["stile-prober"]
+}
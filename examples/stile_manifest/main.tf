@@ -7,9 +7,23 @@ terraform {
   }
 }
 
+# All arguments are optional. api_token falls back to the
+# BUILDKITE_READ_API_TOKEN environment variable.
+provider "stile" {
+  buildkite_org = "stile-education"
+  pipeline      = "big-friendly-pipeline"
+}
+
 data "stile_manifest" "all" {
   bfp_build_number = 926993
   manifest_name = "untested-prober-service-manifest.json"
+  # Fail the read, rather than the output below, if the build drops it.
+  required_service_versions = ["stile-prober"]
+  required_amis = ["base-ami"]
+  # If build 926993 doesn't have the manifest, use the one from the latest
+  # passing build of master, and only then the inline fallback below.
+  fallback_to_latest_passing = true
+  fallback_branch = "master"
   fallback_manifest = jsonencode({
     "name": "926993",
     "commits": {
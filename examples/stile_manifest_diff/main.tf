@@ -0,0 +1,37 @@
+terraform {
+  required_providers {
+    stile = {
+      version = "0.2"
+      source = "hashicorp.com/edu/stile"
+    }
+  }
+}
+
+# What changes if the prober is deployed from the latest passing master
+# build instead of the one that's deployed now.
+data "stile_build" "main" {
+  branch        = "master"
+  with_artifact = "untested-prober-service-manifest.json"
+}
+
+data "stile_manifest_diff" "prober" {
+  manifest_name     = "untested-prober-service-manifest.json"
+  from_build_number = 926993
+  to_build_number   = data.stile_build.main.number
+  architecture      = "IntelLinux"
+}
+
+output "identical" {
+  value = data.stile_manifest_diff.prober.identical
+}
+
+output "changed_services" {
+  value = {
+    for name, version in data.stile_manifest_diff.prober.changed[0].service_versions :
+    name => "${data.stile_manifest_diff.prober.changed_from[0].service_versions[name]} -> ${version}"
+  }
+}
+
+output "added_amis" {
+  value = data.stile_manifest_diff.prober.added[0].amis
+}
@@ -7,10 +7,13 @@ import (
 	"terraform-provider-stile/stile"
 )
 
+// Set by goreleaser at build time.
+var version = "dev"
+
 func main() {
 	plugin.Serve(&plugin.ServeOpts{
 		ProviderFunc: func() *schema.Provider {
-			return stile.Provider()
+			return stile.Provider(version)
 		},
 	})
 }
@@ -0,0 +1,96 @@
+package stile
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// artifactCache remembers the artifact listings and downloaded artifact
+// bodies for the lifetime of the provider, which Terraform starts afresh
+// for every plan or apply. Root modules commonly ask for many manifests
+// from the same build, so without this we'd paginate through the same
+// listing once per data source.
+//
+// Concurrent requests for the same key are collapsed into a single call,
+// in the style of golang.org/x/sync/singleflight. Failures aren't
+// remembered so that a later retry gets to try again.
+type artifactCache struct {
+	mu    sync.Mutex
+	calls map[interface{}]*artifactCacheCall
+}
+
+// artifactListingKey identifies a single build's artifact listing.
+type artifactListingKey struct {
+	org         string
+	pipeline    string
+	buildNumber string
+}
+
+// artifactDownloadKey identifies a single artifact's contents. Artifact
+// IDs are UUIDs so they're unique across builds.
+type artifactDownloadKey struct {
+	artifactID string
+}
+
+type artifactCacheCall struct {
+	done chan struct{}
+	val  interface{}
+	err  error
+}
+
+func newArtifactCache() *artifactCache {
+	return &artifactCache{
+		calls: map[interface{}]*artifactCacheCall{},
+	}
+}
+
+// get returns the cached value for key, calling fetch to populate it if
+// needed. Callers waiting on another caller's fetch give up when their own
+// ctx is done.
+func (c *artifactCache) get(ctx context.Context, key interface{}, fetch func(context.Context) (interface{}, error)) (interface{}, error) {
+	for {
+		c.mu.Lock()
+		call, ok := c.calls[key]
+		if !ok {
+			call = &artifactCacheCall{done: make(chan struct{})}
+			c.calls[key] = call
+		}
+		c.mu.Unlock()
+
+		if !ok {
+			c.run(call, key, func() (interface{}, error) { return fetch(ctx) })
+			return call.val, call.err
+		}
+
+		select {
+		case <-call.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+
+		// The fetch we piggybacked on was cut short by its caller's
+		// context rather than our own, so have another go ourselves.
+		if isContextError(call.err) && ctx.Err() == nil {
+			continue
+		}
+
+		return call.val, call.err
+	}
+}
+
+func (c *artifactCache) run(call *artifactCacheCall, key interface{}, fetch func() (interface{}, error)) {
+	defer close(call.done)
+
+	call.val, call.err = fetch()
+
+	if call.err != nil {
+		c.mu.Lock()
+		delete(c.calls, key)
+		c.mu.Unlock()
+	}
+}
+
+func isContextError(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
@@ -0,0 +1,92 @@
+package stile
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestListBuildkiteArtifactsConcurrent(t *testing.T) {
+	fake := newFakeBuildkite(t)
+	fake.addArtifact(fake.addBuild(5), testManifestName, testManifest)
+	c := testProvider(t, fake).Meta().(*stileClient)
+
+	started, release := fake.holdNext(fake.artifactsPath(5))
+
+	const readers = 10
+	var wg sync.WaitGroup
+	errs := make(chan error, readers)
+	for i := 0; i < readers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			artifacts, err := listBuildkiteArtifacts(context.Background(), c, "5")
+			if err == nil && len(artifacts) != 1 {
+				err = errors.New("wrong number of artifacts")
+			}
+			errs <- err
+		}()
+	}
+
+	// Give the other readers a chance to queue up behind the first.
+	<-started
+	time.Sleep(50 * time.Millisecond)
+	release()
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Errorf("listBuildkiteArtifacts: %v", err)
+		}
+	}
+	if got := fake.requestCount(fake.artifactsPath(5)); got != 1 {
+		t.Errorf("the listing was requested %d times, want 1", got)
+	}
+}
+
+func TestListBuildkiteArtifactsLeaderCancelled(t *testing.T) {
+	fake := newFakeBuildkite(t)
+	fake.addArtifact(fake.addBuild(5), testManifestName, testManifest)
+	c := testProvider(t, fake).Meta().(*stileClient)
+
+	started, release := fake.holdNext(fake.artifactsPath(5))
+
+	leaderCtx, cancel := context.WithCancel(context.Background())
+	leaderErr := make(chan error, 1)
+	go func() {
+		_, err := listBuildkiteArtifacts(leaderCtx, c, "5")
+		leaderErr <- err
+	}()
+	<-started
+
+	type result struct {
+		artifacts int
+		err       error
+	}
+	waiter := make(chan result, 1)
+	go func() {
+		artifacts, err := listBuildkiteArtifacts(context.Background(), c, "5")
+		waiter <- result{len(artifacts), err}
+	}()
+
+	// Let the waiter queue up behind the leader, then cut the leader
+	// short. The waiter should fetch the listing itself rather than
+	// inherit the leader's cancellation.
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	if err := <-leaderErr; !errors.Is(err, context.Canceled) {
+		t.Errorf("leader's error = %v, want context.Canceled", err)
+	}
+	release()
+
+	got := <-waiter
+	if got.err != nil || got.artifacts != 1 {
+		t.Errorf("waiter got %d artifacts and error %v, want 1 artifact", got.artifacts, got.err)
+	}
+	if got := fake.requestCount(fake.artifactsPath(5)); got != 2 {
+		t.Errorf("the listing was requested %d times, want 2", got)
+	}
+}
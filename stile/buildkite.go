@@ -0,0 +1,420 @@
+package stile
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/buildkite/go-buildkite/v2/buildkite"
+)
+
+// The go-buildkite client doesn't accept a context, so these helpers build
+// requests with its NewRequest/Do and attach the context themselves. That
+// way Terraform cancelling a plan, or a data source timing out, aborts any
+// in-flight request.
+
+// listBuildkiteArtifacts returns every artifact of the given build in the
+// configured pipeline. Listings are cached for the lifetime of the
+// provider; a finished build's artifacts don't change.
+func listBuildkiteArtifacts(ctx context.Context, c *stileClient, buildNumber string) ([]buildkite.Artifact, error) {
+	key := artifactListingKey{org: c.org, pipeline: c.pipeline, buildNumber: buildNumber}
+
+	artifacts, err := c.artifacts.get(ctx, key, func(ctx context.Context) (interface{}, error) {
+		if c.offline {
+			artifacts, err := c.cache.getListing(c.org, c.pipeline, buildNumber)
+			if err != nil {
+				return nil, offlineError(c, err)
+			}
+			return artifacts, nil
+		}
+
+		// Artifacts can be uploaded until a build finishes, so only a
+		// finished build's listing is kept on disk. The build is looked
+		// at first: if it had finished before the listing, nothing can
+		// be missing from it.
+		finished := false
+		var err error
+		if c.cache != nil {
+			finished, err = isBuildkiteBuildFinished(ctx, c, buildNumber)
+		}
+
+		var artifacts []buildkite.Artifact
+		if err == nil {
+			artifacts, err = fetchBuildkiteArtifacts(ctx, c, buildNumber)
+		}
+		if err != nil {
+			// A listing we've seen before is better than nothing if
+			// Buildkite can't be reached at all.
+			if c.cache != nil && isUnreachableError(err) {
+				if cached, cacheErr := c.cache.getListing(c.org, c.pipeline, buildNumber); cacheErr == nil {
+					log.Printf("[WARN] Using cached artifact listing of build %s in %s/%s: %v", buildNumber, c.org, c.pipeline, err)
+					return cached, nil
+				}
+			}
+			return nil, err
+		}
+
+		if finished {
+			if err := c.cache.putListing(c.org, c.pipeline, buildNumber, artifacts); err != nil {
+				log.Printf("[WARN] Unable to cache artifact listing of build %s in %s/%s: %v", buildNumber, c.org, c.pipeline, err)
+			}
+		}
+
+		return artifacts, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return artifacts.([]buildkite.Artifact), nil
+}
+
+// isBuildkiteBuildFinished returns whether the given build in the configured
+// pipeline has finished, whether it passed or not.
+func isBuildkiteBuildFinished(ctx context.Context, c *stileClient, buildNumber string) (bool, error) {
+	u := fmt.Sprintf("v2/organizations/%s/pipelines/%s/builds/%s", c.org, c.pipeline, buildNumber)
+
+	var build buildkite.Build
+	err := c.retry.do(ctx, func() error {
+		build = buildkite.Build{}
+		_, err := doBuildkiteRequest(ctx, c, u, &build)
+		return err
+	})
+	if err != nil {
+		log.Printf("get build failed: %s", err)
+		if isContextError(err) {
+			return false, err
+		}
+		return false, diagnosticError{
+			summary: fmt.Sprintf("Unable to get build %s in pipeline %s/%s", buildNumber, c.org, c.pipeline),
+			detail: fmt.Sprintf(
+				"This can mean the build does not exist or your Buildkite API token has insufficient permission to access it: %v",
+				err,
+			),
+			err: err,
+		}
+	}
+
+	return build.FinishedAt != nil, nil
+}
+
+func fetchBuildkiteArtifacts(ctx context.Context, c *stileClient, buildNumber string) ([]buildkite.Artifact, error) {
+	org := c.org
+	pipeline := c.pipeline
+
+	var all []buildkite.Artifact
+
+	// Buildkite's Artifacts API is paginated so we need to go through
+	// every page.
+	page := 0
+	for {
+		u := fmt.Sprintf("v2/organizations/%s/pipelines/%s/builds/%s/artifacts", org, pipeline, buildNumber)
+		if page != 0 {
+			u += "?" + url.Values{"page": {strconv.Itoa(page)}}.Encode()
+		}
+
+		var artifacts []buildkite.Artifact
+		var response *buildkite.Response
+		err := c.retry.do(ctx, func() error {
+			var err error
+			artifacts = nil
+			response, err = doBuildkiteRequest(ctx, c, u, &artifacts)
+			return err
+		})
+
+		if err != nil {
+			log.Printf("list artifacts failed: %s", err)
+			if isContextError(err) {
+				return nil, err
+			}
+			return nil, diagnosticError{
+				summary: fmt.Sprintf("Unable to list buildkite artifacts for build %s in pipeline %s/%s", buildNumber, org, pipeline),
+				detail: fmt.Sprintf(
+					"This can mean the artifact does not exist or your Buildkite API token has insufficient permission to access it: %v",
+					err,
+				),
+				err: err,
+			}
+		}
+
+		all = append(all, artifacts...)
+
+		// This indicates that there are no more pages to look at.
+		if response.NextPage == 0 {
+			break
+		}
+
+		page = response.NextPage
+	}
+
+	return all, nil
+}
+
+// downloadBuildkiteArtifact returns the contents of the given artifact.
+// Downloads are cached for the lifetime of the provider.
+func downloadBuildkiteArtifact(ctx context.Context, c *stileClient, artifact buildkite.Artifact) ([]byte, error) {
+	key := artifactDownloadKey{artifactID: *artifact.ID}
+
+	body, err := c.artifacts.get(ctx, key, func(ctx context.Context) (interface{}, error) {
+		if c.cache != nil {
+			body, err := c.cache.getArtifact(artifact)
+			if err == nil {
+				return body, nil
+			}
+			if c.offline {
+				return nil, offlineError(c, err)
+			}
+		}
+
+		var buf bytes.Buffer
+		err := c.retry.do(ctx, func() error {
+			buf.Reset()
+			if _, err := doBuildkiteRequest(ctx, c, *artifact.DownloadURL, &buf); err != nil {
+				return err
+			}
+			return verifyArtifact(artifact, buf.Bytes())
+		})
+		if err != nil {
+			log.Printf("DownloadArtifactByURL failed: %s", err)
+			if isContextError(err) {
+				return nil, err
+			}
+			var integrityErr *artifactIntegrityError
+			if errors.As(err, &integrityErr) {
+				return nil, diagnosticError{
+					summary: fmt.Sprintf("Artifact %s downloaded from Buildkite failed verification", stringValue(artifact.Filename)),
+					detail:  fmt.Sprintf("%v. The download may have been truncated or tampered with, so it hasn't been used.", err),
+					err:     err,
+				}
+			}
+			return nil, diagnosticError{
+				summary: fmt.Sprintf("Unable to download artifact at URL %s", err),
+				detail:  fmt.Sprintf("DownloadArtifactByURL failed: %s\nAre you on the VPN?", err),
+				err:     err,
+			}
+		}
+
+		if c.cache != nil {
+			if err := c.cache.putArtifact(artifact, buf.Bytes()); err != nil {
+				log.Printf("[WARN] Unable to cache artifact %s: %v", stringValue(artifact.Filename), err)
+			}
+		}
+
+		return buf.Bytes(), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return body.([]byte), nil
+}
+
+// artifactIntegrityError means a downloaded artifact doesn't match the size
+// or SHA-1 that Buildkite has recorded for it.
+type artifactIntegrityError struct {
+	field    string
+	expected string
+	actual   string
+}
+
+func (e *artifactIntegrityError) Error() string {
+	return fmt.Sprintf("expected %s %s, got %s", e.field, e.expected, e.actual)
+}
+
+// verifyArtifact checks body against the size and SHA-1 Buildkite recorded
+// when the artifact was uploaded. Either is skipped if Buildkite didn't
+// tell us it.
+func verifyArtifact(artifact buildkite.Artifact, body []byte) error {
+	if artifact.FileSize != nil && int64(len(body)) != *artifact.FileSize {
+		return &artifactIntegrityError{
+			field:    "size",
+			expected: strconv.FormatInt(*artifact.FileSize, 10),
+			actual:   strconv.Itoa(len(body)),
+		}
+	}
+
+	if expected := stringValue(artifact.SHA1); expected != "" {
+		actual := fmt.Sprintf("%x", sha1.Sum(body))
+		if !strings.EqualFold(actual, expected) {
+			return &artifactIntegrityError{
+				field:    "sha1sum",
+				expected: expected,
+				actual:   actual,
+			}
+		}
+	}
+
+	return nil
+}
+
+// doBuildkiteRequest GETs urlStr, which may be relative to the client's
+// base URL, decoding the response into v (or copying it, if v is an
+// io.Writer).
+func doBuildkiteRequest(ctx context.Context, c *stileClient, urlStr string, v interface{}) (*buildkite.Response, error) {
+	req, err := c.buildkite.NewRequest("GET", urlStr, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := c.buildkite.Do(req.WithContext(ctx), v)
+	// The HTTP client wraps context errors in a *url.Error, and the
+	// Buildkite client can wrap that further, so surface the context's
+	// own error to make cancellation easy to recognise.
+	if err != nil && ctx.Err() != nil {
+		return response, ctx.Err()
+	}
+
+	return response, err
+}
+
+// buildFilter narrows down the builds findBuildkiteBuild looks at. Empty
+// fields don't filter.
+type buildFilter struct {
+	branch string
+	commit string
+	states []string
+	// Only consider builds that produced an artifact with this filename.
+	artifactName string
+}
+
+// maxBuildsSearched bounds how far back findBuildkiteBuild will look for a
+// build containing filter.artifactName, as each candidate costs an
+// artifact listing.
+const maxBuildsSearched = 100
+
+// findBuildkiteBuild returns the most recently created build in the
+// configured pipeline matching filter, or nil if there isn't one.
+func findBuildkiteBuild(ctx context.Context, c *stileClient, filter buildFilter) (*buildkite.Build, error) {
+	org := c.org
+	pipeline := c.pipeline
+
+	// Which builds match a search changes all the time, unlike a build's
+	// artifacts, so searches aren't cached.
+	if c.offline {
+		return nil, diagnosticError{
+			summary: fmt.Sprintf("Unable to search for builds in %s/%s in offline mode", org, pipeline),
+			detail:  "Only builds that have been seen before, by number, are available offline. Use a build number instead, or turn off offline (or STILE_OFFLINE).",
+		}
+	}
+
+	query := url.Values{}
+	if filter.branch != "" {
+		query.Set("branch", filter.branch)
+	}
+	if filter.commit != "" {
+		query.Set("commit", filter.commit)
+	}
+	for _, state := range filter.states {
+		query.Add("state[]", state)
+	}
+
+	searched := 0
+
+	// Buildkite returns builds newest first, a page at a time.
+	page := 0
+	for {
+		if page != 0 {
+			query.Set("page", strconv.Itoa(page))
+		}
+		u := fmt.Sprintf("v2/organizations/%s/pipelines/%s/builds?%s", org, pipeline, query.Encode())
+
+		var builds []buildkite.Build
+		var response *buildkite.Response
+		err := c.retry.do(ctx, func() error {
+			var err error
+			builds = nil
+			response, err = doBuildkiteRequest(ctx, c, u, &builds)
+			return err
+		})
+
+		if err != nil {
+			log.Printf("list builds failed: %s", err)
+			if isContextError(err) {
+				return nil, err
+			}
+			return nil, diagnosticError{
+				summary: fmt.Sprintf("Unable to list buildkite builds in pipeline %s/%s", org, pipeline),
+				detail: fmt.Sprintf(
+					"This can mean your Buildkite API token has insufficient permission to access the pipeline: %v",
+					err,
+				),
+				err: err,
+			}
+		}
+
+		for i := range builds {
+			build := builds[i]
+
+			if filter.artifactName == "" {
+				return &build, nil
+			}
+
+			if searched >= maxBuildsSearched {
+				return nil, diagnosticError{
+					summary: fmt.Sprintf("No build with artifact %s in the latest %d matching builds in %s/%s", filter.artifactName, maxBuildsSearched, org, pipeline),
+					detail:  "Narrow down the search, eg: by branch or commit, or specify a build number directly.",
+				}
+			}
+			searched++
+
+			artifacts, err := listBuildkiteArtifacts(ctx, c, strconv.Itoa(*build.Number))
+			if err != nil {
+				return nil, err
+			}
+			for _, artifact := range artifacts {
+				if *artifact.Filename == filter.artifactName {
+					return &build, nil
+				}
+			}
+		}
+
+		if response.NextPage == 0 {
+			return nil, nil
+		}
+
+		page = response.NextPage
+	}
+}
+
+// sleepContext waits for d, returning early with the context's error if ctx
+// is done first.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func getBuildkiteArtifact(ctx context.Context, c *stileClient, artifactName string, buildNumber string) (io.Reader, error) {
+	artifacts, err := listBuildkiteArtifacts(ctx, c, buildNumber)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, artifact := range artifacts {
+		if artifactName == *artifact.Filename || artifactName == *artifact.ID {
+			body, err := downloadBuildkiteArtifact(ctx, c, artifact)
+			if err != nil {
+				return nil, err
+			}
+
+			return bytes.NewReader(body), nil
+		}
+	}
+
+	log.Printf("Could not find manifest %s for build number %s in %s/%s", artifactName, buildNumber, c.org, c.pipeline)
+	return nil, nil
+}
@@ -0,0 +1,48 @@
+package stile
+
+import (
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/buildkite/go-buildkite/v2/buildkite"
+)
+
+func TestVerifyArtifact(t *testing.T) {
+	body := []byte(testManifest)
+	size := int64(len(body))
+	otherSize := size - 1
+	sha1sum := fmt.Sprintf("%x", sha1.Sum(body))
+	upperSHA1 := fmt.Sprintf("%X", sha1.Sum(body))
+	otherSHA1 := fmt.Sprintf("%x", sha1.Sum([]byte(testFallbackManifest)))
+
+	tests := []struct {
+		name      string
+		artifact  buildkite.Artifact
+		wantField string
+	}{
+		{name: "matches", artifact: buildkite.Artifact{FileSize: &size, SHA1: &sha1sum}},
+		{name: "upper case SHA-1", artifact: buildkite.Artifact{FileSize: &size, SHA1: &upperSHA1}},
+		{name: "nothing recorded", artifact: buildkite.Artifact{}},
+		{name: "wrong size", artifact: buildkite.Artifact{FileSize: &otherSize, SHA1: &sha1sum}, wantField: "size"},
+		{name: "wrong SHA-1", artifact: buildkite.Artifact{FileSize: &size, SHA1: &otherSHA1}, wantField: "sha1sum"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := verifyArtifact(test.artifact, body)
+			if test.wantField == "" {
+				if err != nil {
+					t.Errorf("verifyArtifact = %v, want nil", err)
+				}
+				return
+			}
+
+			var integrityErr *artifactIntegrityError
+			if !errors.As(err, &integrityErr) || integrityErr.field != test.wantField {
+				t.Errorf("verifyArtifact = %v, want an artifactIntegrityError for %s", err, test.wantField)
+			}
+		})
+	}
+}
@@ -0,0 +1,88 @@
+package stile
+
+import (
+	"crypto/ed25519"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/buildkite/go-buildkite/v2/buildkite"
+)
+
+// stileClient is the provider's configuration, built once by
+// providerConfigure and handed to every data source as `meta`.
+type stileClient struct {
+	org      string
+	pipeline string
+
+	// Shared by every data source so that connections are reused across
+	// reads. This is nil when no API token was configured, in which case
+	// anything that needs to talk to Buildkite should return an error
+	// diagnostic.
+	buildkite *buildkite.Client
+
+	// For manifests that come from a URL rather than Buildkite.
+	http *http.Client
+
+	// Where builds' manifests come from by default, see
+	// manifest_source.go.
+	manifestSource ManifestSource
+	// For manifest sources in S3.
+	s3 *s3Config
+
+	artifacts *artifactCache
+	retry     retryPolicy
+
+	// Artifacts are also kept on disk if cache_dir is set, which is
+	// all that's used when offline. There's no Buildkite client needed
+	// then.
+	cache   *diskCache
+	offline bool
+
+	manifestPublicKeys     []ed25519.PublicKey
+	requireSignedManifests bool
+}
+
+// newBuildkiteClient builds a Buildkite API client for the given base URL.
+// Requests are held back for at most maxRateLimitWait once the rate limit
+// is used up. The returned client is safe for concurrent use.
+func newBuildkiteClient(apiToken string, baseURL *url.URL, userAgent string, maxRateLimitWait time.Duration) (*buildkite.Client, error) {
+	config, err := buildkite.NewTokenConfig(apiToken, false)
+	if err != nil {
+		return nil, err
+	}
+
+	config.Transport = &rateLimitTransport{maxWait: maxRateLimitWait, next: &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   16,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: 30 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}}
+
+	httpClient := config.Client()
+	// A backstop in case a server accepts the connection and then never
+	// finishes sending the body.
+	httpClient.Timeout = 2 * time.Minute
+
+	client := buildkite.NewClient(httpClient)
+	client.BaseURL = baseURL
+
+	// The token is only sent to requests for this host, so it needs to
+	// match the base URL we're actually talking to. Artifact downloads
+	// redirect to S3 which mustn't receive it. This has to happen after
+	// NewClient, which sets it for the default base URL.
+	config.APIHost = baseURL.Host
+	client.UserAgent = fmt.Sprintf("%s %s", userAgent, client.UserAgent)
+
+	return client, nil
+}
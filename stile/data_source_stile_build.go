@@ -0,0 +1,178 @@
+package stile
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/buildkite/go-buildkite/v2/buildkite"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/diag"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+)
+
+// dataStileBuild finds the most recent build in the pipeline matching some
+// filters, so that modules can track a branch rather than having a build
+// number hard-coded, eg:
+//
+//	data "stile_build" "main" {
+//	  branch        = "master"
+//	  with_artifact = "untested-prober-service-manifest.json"
+//	}
+//
+//	data "stile_manifest" "prober" {
+//	  bfp_build_number = data.stile_build.main.number
+//	  ...
+//	}
+func dataStileBuild() *schema.Resource {
+	return &schema.Resource{
+		ReadContext: dataStileBuildRead,
+		Timeouts: &schema.ResourceTimeout{
+			Read: schema.DefaultTimeout(5 * time.Minute),
+		},
+		Schema: map[string]*schema.Schema{
+			"branch": {
+				Type:     schema.TypeString,
+				Optional: true,
+				Required: false,
+				Computed: true,
+			},
+			// Must be the full SHA, Buildkite doesn't match on
+			// abbreviated ones.
+			"commit": {
+				Type:     schema.TypeString,
+				Optional: true,
+				Required: false,
+				Computed: true,
+			},
+			// One of Buildkite's build states, eg: "passed", "failed",
+			// "running".
+			"state": {
+				Type:     schema.TypeString,
+				Optional: true,
+				Required: false,
+				Computed: false,
+				Default:  "passed",
+			},
+			// Skip builds that didn't produce an artifact with this
+			// filename, eg: a manifest that's only built on some
+			// branches.
+			"with_artifact": {
+				Type:     schema.TypeString,
+				Optional: true,
+				Required: false,
+				Computed: false,
+			},
+			"number": {
+				Type:     schema.TypeInt,
+				Computed: true,
+			},
+			"web_url": {
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+			// RFC 3339 timestamps.
+			"created_at": {
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+			"finished_at": {
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+		},
+	}
+}
+
+func dataStileBuildRead(ctx context.Context, d *schema.ResourceData, m interface{}) diag.Diagnostics {
+	var diags diag.Diagnostics
+
+	c := m.(*stileClient)
+
+	if err := requireBuildkite(c); err != nil {
+		return append(diags, diagnosticsFromError(err, "Unable to talk to Buildkite")...)
+	}
+
+	filter := buildFilter{
+		branch:       d.Get("branch").(string),
+		commit:       d.Get("commit").(string),
+		artifactName: d.Get("with_artifact").(string),
+	}
+	if state := d.Get("state").(string); state != "" {
+		filter.states = []string{state}
+	}
+
+	build, err := findBuildkiteBuild(ctx, c, filter)
+	if err != nil {
+		return diagnosticsFromError(err, "Failed to find Buildkite build")
+	}
+
+	if build == nil {
+		diags = append(diags, diag.Diagnostic{
+			Severity: diag.Error,
+			Summary:  fmt.Sprintf("No build found in %s/%s matching %s", c.org, c.pipeline, describeBuildFilter(filter)),
+		})
+		return diags
+	}
+
+	if err := d.Set("number", *build.Number); err != nil {
+		return diag.FromErr(err)
+	}
+	if err := d.Set("branch", stringValue(build.Branch)); err != nil {
+		return diag.FromErr(err)
+	}
+	if err := d.Set("commit", stringValue(build.Commit)); err != nil {
+		return diag.FromErr(err)
+	}
+	if err := d.Set("state", stringValue(build.State)); err != nil {
+		return diag.FromErr(err)
+	}
+	if err := d.Set("web_url", stringValue(build.WebURL)); err != nil {
+		return diag.FromErr(err)
+	}
+	if err := d.Set("created_at", timestampValue(build.CreatedAt)); err != nil {
+		return diag.FromErr(err)
+	}
+	if err := d.Set("finished_at", timestampValue(build.FinishedAt)); err != nil {
+		return diag.FromErr(err)
+	}
+
+	d.SetId(strconv.Itoa(*build.Number))
+
+	return diags
+}
+
+func describeBuildFilter(filter buildFilter) string {
+	var parts []string
+	if filter.branch != "" {
+		parts = append(parts, fmt.Sprintf("branch %q", filter.branch))
+	}
+	if filter.commit != "" {
+		parts = append(parts, fmt.Sprintf("commit %q", filter.commit))
+	}
+	if len(filter.states) != 0 {
+		parts = append(parts, fmt.Sprintf("state %q", strings.Join(filter.states, ",")))
+	}
+	if filter.artifactName != "" {
+		parts = append(parts, fmt.Sprintf("artifact %q", filter.artifactName))
+	}
+	if len(parts) == 0 {
+		return "any build"
+	}
+	return strings.Join(parts, ", ")
+}
+
+func stringValue(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
+func timestampValue(ts *buildkite.Timestamp) string {
+	if ts == nil {
+		return ""
+	}
+	return ts.Format(time.RFC3339)
+}
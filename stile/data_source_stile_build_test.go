@@ -0,0 +1,112 @@
+package stile
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestDataStileBuildRead(t *testing.T) {
+	fake := newFakeBuildkite(t)
+	withManifest := fake.addBuild(1)
+	fake.addArtifact(withManifest, testManifestName, testManifest)
+	fake.addBuild(2).branch = "feature"
+	fake.addBuild(3).state = "failed"
+	fake.addBuild(4)
+	fake.addBuild(5).state = "running"
+	p := testProvider(t, fake)
+
+	tests := []struct {
+		name           string
+		raw            map[string]interface{}
+		wantNumber     int
+		wantErrSummary string
+	}{
+		{name: "latest passed", raw: map[string]interface{}{}, wantNumber: 4},
+		{name: "branch", raw: map[string]interface{}{"branch": "feature"}, wantNumber: 2},
+		{name: "commit", raw: map[string]interface{}{"commit": fmt.Sprintf("%040d", 1)}, wantNumber: 1},
+		{name: "state", raw: map[string]interface{}{"state": "failed"}, wantNumber: 3},
+		{name: "running", raw: map[string]interface{}{"state": "running"}, wantNumber: 5},
+		{name: "with_artifact", raw: map[string]interface{}{"with_artifact": testManifestName}, wantNumber: 1},
+		{
+			name:           "no build",
+			raw:            map[string]interface{}{"branch": "feature", "with_artifact": testManifestName},
+			wantErrSummary: `No build found in test-org/test-pipeline matching branch "feature", state "passed", artifact "untested-prober-service-manifest.json"`,
+		},
+		{
+			name:           "no build on the branch",
+			raw:            map[string]interface{}{"branch": "missing"},
+			wantErrSummary: `No build found in test-org/test-pipeline matching branch "missing", state "passed"`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			d, diags := readDataSource(t, p, "stile_build", test.raw)
+			if test.wantErrSummary != "" {
+				requireError(t, diags, test.wantErrSummary)
+				return
+			}
+			requireNoErrors(t, diags)
+
+			if got := d.Get("number"); got != test.wantNumber {
+				t.Errorf("number = %v, want %d", got, test.wantNumber)
+			}
+			if got, want := d.Id(), fmt.Sprint(test.wantNumber); got != want {
+				t.Errorf("id = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestDataStileBuildReadAttributes(t *testing.T) {
+	fake := newFakeBuildkite(t)
+	fake.addBuild(4)
+	fake.addBuild(5).state = "running"
+	p := testProvider(t, fake)
+
+	d, diags := readDataSource(t, p, "stile_build", map[string]interface{}{})
+	requireNoErrors(t, diags)
+
+	want := map[string]string{
+		"branch":      "master",
+		"commit":      fmt.Sprintf("%040d", 4),
+		"state":       "passed",
+		"web_url":     "https://buildkite.com/test-org/test-pipeline/builds/4",
+		"created_at":  "2020-01-01T00:00:04Z",
+		"finished_at": "2020-01-01T00:01:04Z",
+	}
+	for key, value := range want {
+		if got := d.Get(key); got != value {
+			t.Errorf("%s = %q, want %q", key, got, value)
+		}
+	}
+
+	// A build that hasn't finished has no finished_at.
+	d, diags = readDataSource(t, p, "stile_build", map[string]interface{}{"state": "running"})
+	requireNoErrors(t, diags)
+	if got := d.Get("finished_at"); got != "" {
+		t.Errorf("finished_at of a running build = %q, want it empty", got)
+	}
+}
+
+func TestDataStileBuildReadMaxBuildsSearched(t *testing.T) {
+	fake := newFakeBuildkite(t)
+	for number := 1; number <= maxBuildsSearched+1; number++ {
+		fake.addBuild(number)
+	}
+	fake.addArtifact(fake.builds[1], testManifestName, testManifest)
+	p := testProvider(t, fake)
+
+	_, diags := readDataSource(t, p, "stile_build", map[string]interface{}{
+		"with_artifact": testManifestName,
+	})
+	requireError(t, diags, fmt.Sprintf("No build with artifact %s in the latest %d matching builds in test-org/test-pipeline", testManifestName, maxBuildsSearched))
+
+	// The oldest build, which has the artifact, is past the cut-off.
+	if got := fake.requestCount(fake.artifactsPath(1)); got != 0 {
+		t.Errorf("build 1's artifacts were listed %d times, want 0", got)
+	}
+	if got := fake.requestCount(fake.artifactsPath(2)); got != 1 {
+		t.Errorf("build 2's artifacts were listed %d times, want 1", got)
+	}
+}
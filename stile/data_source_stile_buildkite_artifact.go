@@ -0,0 +1,224 @@
+package stile
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/buildkite/go-buildkite/v2/buildkite"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/diag"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+)
+
+// dataStileBuildkiteArtifact fetches any single artifact from a build in
+// the pipeline, eg: rendered config, an SBOM or a version file.
+func dataStileBuildkiteArtifact() *schema.Resource {
+	return &schema.Resource{
+		ReadContext: dataStileBuildkiteArtifactRead,
+		Timeouts: &schema.ResourceTimeout{
+			Read: schema.DefaultTimeout(5 * time.Minute),
+		},
+		Schema: map[string]*schema.Schema{
+			"build_number": {
+				Type:     schema.TypeInt,
+				Required: true,
+				Optional: false,
+				Computed: false,
+			},
+			// Exactly one of these picks the artifact. "path" is the
+			// artifact's full path as uploaded, eg: "build/version.txt",
+			// and "glob" is matched against it with Go's path.Match
+			// syntax. Whichever is used must match exactly one artifact.
+			"filename": {
+				Type:         schema.TypeString,
+				Optional:     true,
+				Required:     false,
+				Computed:     false,
+				ExactlyOneOf: []string{"filename", "path", "glob"},
+			},
+			"path": {
+				Type:         schema.TypeString,
+				Optional:     true,
+				Required:     false,
+				Computed:     false,
+				ExactlyOneOf: []string{"filename", "path", "glob"},
+			},
+			"glob": {
+				Type:         schema.TypeString,
+				Optional:     true,
+				Required:     false,
+				Computed:     false,
+				ExactlyOneOf: []string{"filename", "path", "glob"},
+			},
+			// Only consider artifacts uploaded by this job. Useful when
+			// several jobs upload artifacts with the same name.
+			"job_id": {
+				Type:     schema.TypeString,
+				Optional: true,
+				Required: false,
+				Computed: false,
+			},
+			// Empty if the artifact isn't valid UTF-8, in which case use
+			// content_base64.
+			"content": {
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+			"content_base64": {
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+			"sha1sum": {
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+			"mime_type": {
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+			"file_size": {
+				Type:     schema.TypeInt,
+				Computed: true,
+			},
+			"download_url": {
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+		},
+	}
+}
+
+func dataStileBuildkiteArtifactRead(ctx context.Context, d *schema.ResourceData, m interface{}) diag.Diagnostics {
+	var diags diag.Diagnostics
+
+	c := m.(*stileClient)
+
+	if err := requireBuildkite(c); err != nil {
+		return append(diags, diagnosticsFromError(err, "Unable to talk to Buildkite")...)
+	}
+
+	buildNumber := strconv.Itoa(d.Get("build_number").(int))
+	filename := d.Get("filename").(string)
+	artifactPath := d.Get("path").(string)
+	glob := d.Get("glob").(string)
+	jobID := d.Get("job_id").(string)
+
+	// Catch a bad pattern up front, path.Match only reports it when it
+	// gets that far through the pattern.
+	if glob != "" {
+		if _, err := path.Match(glob, ""); err != nil {
+			return diag.Errorf("Invalid glob %q: %v", glob, err)
+		}
+	}
+
+	artifacts, err := listBuildkiteArtifacts(ctx, c, buildNumber)
+	if err != nil {
+		return diagnosticsFromError(err, "Failed to list Buildkite artifacts")
+	}
+
+	var matches []buildkite.Artifact
+	for _, artifact := range artifacts {
+		if jobID != "" && stringValue(artifact.JobID) != jobID {
+			continue
+		}
+
+		var ok bool
+		switch {
+		case filename != "":
+			ok = stringValue(artifact.Filename) == filename
+		case artifactPath != "":
+			ok = stringValue(artifact.Path) == artifactPath
+		default:
+			ok, _ = path.Match(glob, stringValue(artifact.Path))
+		}
+		if ok {
+			matches = append(matches, artifact)
+		}
+	}
+
+	if len(matches) == 0 {
+		diags = append(diags, diag.Diagnostic{
+			Severity: diag.Error,
+			Summary:  fmt.Sprintf("No artifact matching %s found for build %s in %s/%s", describeArtifactFilter(filename, artifactPath, glob, jobID), buildNumber, c.org, c.pipeline),
+		})
+		return diags
+	}
+	if len(matches) > 1 {
+		var paths []string
+		for _, artifact := range matches {
+			paths = append(paths, fmt.Sprintf("%s (job %s)", stringValue(artifact.Path), stringValue(artifact.JobID)))
+		}
+		diags = append(diags, diag.Diagnostic{
+			Severity: diag.Error,
+			Summary:  fmt.Sprintf("%d artifacts matching %s found for build %s in %s/%s", len(matches), describeArtifactFilter(filename, artifactPath, glob, jobID), buildNumber, c.org, c.pipeline),
+			Detail:   fmt.Sprintf("Narrow it down to one, eg: with path or job_id. Matching artifacts:\n%s", strings.Join(paths, "\n")),
+		})
+		return diags
+	}
+
+	artifact := matches[0]
+
+	body, err := downloadBuildkiteArtifact(ctx, c, artifact)
+	if err != nil {
+		return diagnosticsFromError(err, "Failed to download Buildkite artifact")
+	}
+
+	content := ""
+	if utf8.Valid(body) {
+		content = string(body)
+	} else {
+		diags = append(diags, diag.Diagnostic{
+			Severity: diag.Warning,
+			Summary:  fmt.Sprintf("Artifact %s isn't valid UTF-8", stringValue(artifact.Path)),
+			Detail:   "content is empty, use content_base64 instead.",
+		})
+	}
+
+	if err := d.Set("content", content); err != nil {
+		return diag.FromErr(err)
+	}
+	if err := d.Set("content_base64", base64.StdEncoding.EncodeToString(body)); err != nil {
+		return diag.FromErr(err)
+	}
+	if err := d.Set("sha1sum", stringValue(artifact.SHA1)); err != nil {
+		return diag.FromErr(err)
+	}
+	if err := d.Set("mime_type", stringValue(artifact.MimeType)); err != nil {
+		return diag.FromErr(err)
+	}
+	fileSize := 0
+	if artifact.FileSize != nil {
+		fileSize = int(*artifact.FileSize)
+	}
+	if err := d.Set("file_size", fileSize); err != nil {
+		return diag.FromErr(err)
+	}
+	if err := d.Set("download_url", stringValue(artifact.DownloadURL)); err != nil {
+		return diag.FromErr(err)
+	}
+
+	d.SetId(stringValue(artifact.ID))
+
+	return diags
+}
+
+func describeArtifactFilter(filename string, artifactPath string, glob string, jobID string) string {
+	var description string
+	switch {
+	case filename != "":
+		description = fmt.Sprintf("filename %q", filename)
+	case artifactPath != "":
+		description = fmt.Sprintf("path %q", artifactPath)
+	default:
+		description = fmt.Sprintf("glob %q", glob)
+	}
+	if jobID != "" {
+		description += fmt.Sprintf(" in job %s", jobID)
+	}
+	return description
+}
@@ -0,0 +1,98 @@
+package stile
+
+import (
+	"encoding/base64"
+	"testing"
+)
+
+func TestDataStileBuildkiteArtifactRead(t *testing.T) {
+	fake := newFakeBuildkite(t)
+	build := fake.addBuild(5)
+	fake.addArtifactAt(build, "build/version.txt", "job-a", "1.2.3")
+	fake.addArtifactAt(build, "build/sbom.json", "job-a", `{"sbom": true}`)
+	fake.addArtifactAt(build, "linux/config.yml", "job-linux", "os: linux")
+	fake.addArtifactAt(build, "windows/config.yml", "job-windows", "os: windows")
+	p := testProvider(t, fake)
+
+	tests := []struct {
+		name           string
+		raw            map[string]interface{}
+		wantContent    string
+		wantErrSummary string
+	}{
+		{name: "filename", raw: map[string]interface{}{"filename": "version.txt"}, wantContent: "1.2.3"},
+		{name: "path", raw: map[string]interface{}{"path": "linux/config.yml"}, wantContent: "os: linux"},
+		{name: "glob", raw: map[string]interface{}{"glob": "build/*.json"}, wantContent: `{"sbom": true}`},
+		{name: "job_id", raw: map[string]interface{}{"filename": "config.yml", "job_id": "job-windows"}, wantContent: "os: windows"},
+		{
+			name:           "ambiguous",
+			raw:            map[string]interface{}{"filename": "config.yml"},
+			wantErrSummary: `2 artifacts matching filename "config.yml" found for build 5 in test-org/test-pipeline`,
+		},
+		{
+			name:           "ambiguous glob",
+			raw:            map[string]interface{}{"glob": "*/config.yml"},
+			wantErrSummary: `2 artifacts matching glob "*/config.yml" found for build 5 in test-org/test-pipeline`,
+		},
+		{
+			name:           "no match",
+			raw:            map[string]interface{}{"path": "build/missing.txt"},
+			wantErrSummary: `No artifact matching path "build/missing.txt" found for build 5 in test-org/test-pipeline`,
+		},
+		{
+			name:           "no match in job",
+			raw:            map[string]interface{}{"filename": "version.txt", "job_id": "job-linux"},
+			wantErrSummary: `No artifact matching filename "version.txt" in job job-linux found for build 5 in test-org/test-pipeline`,
+		},
+		{
+			name:           "bad glob",
+			raw:            map[string]interface{}{"glob": "build/[.txt"},
+			wantErrSummary: `Invalid glob "build/[.txt": syntax error in pattern`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.raw["build_number"] = 5
+			d, diags := readDataSource(t, p, "stile_buildkite_artifact", test.raw)
+			if test.wantErrSummary != "" {
+				requireError(t, diags, test.wantErrSummary)
+				return
+			}
+			requireNoErrors(t, diags)
+
+			if got := d.Get("content"); got != test.wantContent {
+				t.Errorf("content = %q, want %q", got, test.wantContent)
+			}
+			if got, want := d.Get("content_base64"), base64.StdEncoding.EncodeToString([]byte(test.wantContent)); got != want {
+				t.Errorf("content_base64 = %q, want %q", got, want)
+			}
+			if got := d.Get("file_size"); got != len(test.wantContent) {
+				t.Errorf("file_size = %v, want %d", got, len(test.wantContent))
+			}
+		})
+	}
+}
+
+func TestDataStileBuildkiteArtifactReadBinary(t *testing.T) {
+	fake := newFakeBuildkite(t)
+	body := "\xff\xfe\x00binary"
+	fake.addArtifactAt(fake.addBuild(5), "build/image.bin", "job-a", body)
+	p := testProvider(t, fake)
+
+	d, diags := readDataSource(t, p, "stile_buildkite_artifact", map[string]interface{}{
+		"build_number": 5,
+		"filename":     "image.bin",
+	})
+	requireNoErrors(t, diags)
+
+	if !hasWarning(diags, "Artifact build/image.bin isn't valid UTF-8") {
+		t.Errorf("expected a warning about invalid UTF-8, got: %v", diags)
+	}
+	if got := d.Get("content"); got != "" {
+		t.Errorf("content = %q, want it empty", got)
+	}
+	if got, want := d.Get("content_base64"), base64.StdEncoding.EncodeToString([]byte(body)); got != want {
+		t.Errorf("content_base64 = %q, want %q", got, want)
+	}
+}
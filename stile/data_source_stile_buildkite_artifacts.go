@@ -0,0 +1,164 @@
+package stile
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/terraform-plugin-sdk/v2/diag"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+)
+
+// dataStileBuildkiteArtifacts lists the artifacts of a build in the
+// pipeline, eg: to discover which manifests it produced.
+func dataStileBuildkiteArtifacts() *schema.Resource {
+	return &schema.Resource{
+		ReadContext: dataStileBuildkiteArtifactsRead,
+		Timeouts: &schema.ResourceTimeout{
+			Read: schema.DefaultTimeout(5 * time.Minute),
+		},
+		Schema: map[string]*schema.Schema{
+			"build_number": {
+				Type:     schema.TypeInt,
+				Required: true,
+				Optional: false,
+				Computed: false,
+			},
+			// Filters, all of which must match if given.
+			"filename_regex": {
+				Type:     schema.TypeString,
+				Optional: true,
+				Required: false,
+				Computed: false,
+				ValidateFunc: func(v interface{}, k string) ([]string, []error) {
+					if _, err := regexp.Compile(v.(string)); err != nil {
+						return nil, []error{fmt.Errorf("%q must be a valid regular expression: %v", k, err)}
+					}
+					return nil, nil
+				},
+			},
+			"path_prefix": {
+				Type:     schema.TypeString,
+				Optional: true,
+				Required: false,
+				Computed: false,
+			},
+			"job_id": {
+				Type:     schema.TypeString,
+				Optional: true,
+				Required: false,
+				Computed: false,
+			},
+			// One of Buildkite's artifact states, eg: "finished" or
+			// "error".
+			"state": {
+				Type:     schema.TypeString,
+				Optional: true,
+				Required: false,
+				Computed: false,
+			},
+			// In the order Buildkite returns them.
+			"artifacts": {
+				Type:     schema.TypeList,
+				Computed: true,
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"id": {
+							Type:     schema.TypeString,
+							Computed: true,
+						},
+						"filename": {
+							Type:     schema.TypeString,
+							Computed: true,
+						},
+						"path": {
+							Type:     schema.TypeString,
+							Computed: true,
+						},
+						"job_id": {
+							Type:     schema.TypeString,
+							Computed: true,
+						},
+						"sha1sum": {
+							Type:     schema.TypeString,
+							Computed: true,
+						},
+						"file_size": {
+							Type:     schema.TypeInt,
+							Computed: true,
+						},
+						"state": {
+							Type:     schema.TypeString,
+							Computed: true,
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+func dataStileBuildkiteArtifactsRead(ctx context.Context, d *schema.ResourceData, m interface{}) diag.Diagnostics {
+	var diags diag.Diagnostics
+
+	c := m.(*stileClient)
+
+	if err := requireBuildkite(c); err != nil {
+		return append(diags, diagnosticsFromError(err, "Unable to talk to Buildkite")...)
+	}
+
+	buildNumber := strconv.Itoa(d.Get("build_number").(int))
+	pathPrefix := d.Get("path_prefix").(string)
+	jobID := d.Get("job_id").(string)
+	state := d.Get("state").(string)
+
+	// Already checked by the schema's ValidateFunc.
+	filenameRegex, _ := regexp.Compile(d.Get("filename_regex").(string))
+
+	artifacts, err := listBuildkiteArtifacts(ctx, c, buildNumber)
+	if err != nil {
+		return diagnosticsFromError(err, "Failed to list Buildkite artifacts")
+	}
+
+	result := []interface{}{}
+	for _, artifact := range artifacts {
+		if !filenameRegex.MatchString(stringValue(artifact.Filename)) {
+			continue
+		}
+		if !strings.HasPrefix(stringValue(artifact.Path), pathPrefix) {
+			continue
+		}
+		if jobID != "" && stringValue(artifact.JobID) != jobID {
+			continue
+		}
+		if state != "" && stringValue(artifact.State) != state {
+			continue
+		}
+
+		fileSize := 0
+		if artifact.FileSize != nil {
+			fileSize = int(*artifact.FileSize)
+		}
+
+		result = append(result, map[string]interface{}{
+			"id":        stringValue(artifact.ID),
+			"filename":  stringValue(artifact.Filename),
+			"path":      stringValue(artifact.Path),
+			"job_id":    stringValue(artifact.JobID),
+			"sha1sum":   stringValue(artifact.SHA1),
+			"file_size": fileSize,
+			"state":     stringValue(artifact.State),
+		})
+	}
+
+	if err := d.Set("artifacts", result); err != nil {
+		return diag.FromErr(err)
+	}
+
+	d.SetId(fmt.Sprintf("%s/%s/%s", c.org, c.pipeline, buildNumber))
+
+	return diags
+}
@@ -0,0 +1,107 @@
+package stile
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestDataStileBuildkiteArtifactsRead(t *testing.T) {
+	fake := newFakeBuildkite(t)
+	build := fake.addBuild(5)
+	fake.addArtifactAt(build, "manifests/prober.json", "job-a", `{"name": "prober"}`)
+	fake.addArtifactAt(build, "manifests/web.json", "job-b", `{"name": "web"}`)
+	fake.addArtifactAt(build, "logs/build.log", "job-a", "ok")
+	fake.addArtifactAt(build, "manifests/broken.json", "job-b", "")
+	build.artifacts[3].state = "error"
+	p := testProvider(t, fake)
+
+	tests := []struct {
+		name      string
+		raw       map[string]interface{}
+		wantPaths []string
+	}{
+		{
+			name:      "everything",
+			raw:       map[string]interface{}{},
+			wantPaths: []string{"manifests/prober.json", "manifests/web.json", "logs/build.log", "manifests/broken.json"},
+		},
+		{
+			name:      "filename_regex",
+			raw:       map[string]interface{}{"filename_regex": `\.json$`},
+			wantPaths: []string{"manifests/prober.json", "manifests/web.json", "manifests/broken.json"},
+		},
+		{
+			name:      "path_prefix",
+			raw:       map[string]interface{}{"path_prefix": "logs/"},
+			wantPaths: []string{"logs/build.log"},
+		},
+		{
+			name:      "job_id",
+			raw:       map[string]interface{}{"job_id": "job-a"},
+			wantPaths: []string{"manifests/prober.json", "logs/build.log"},
+		},
+		{
+			name:      "state",
+			raw:       map[string]interface{}{"state": "error"},
+			wantPaths: []string{"manifests/broken.json"},
+		},
+		{
+			name:      "all filters",
+			raw:       map[string]interface{}{"filename_regex": `^[a-z]+\.json$`, "path_prefix": "manifests/", "job_id": "job-b", "state": "finished"},
+			wantPaths: []string{"manifests/web.json"},
+		},
+		{
+			name:      "nothing matches",
+			raw:       map[string]interface{}{"path_prefix": "missing/"},
+			wantPaths: []string{},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.raw["build_number"] = 5
+			d, diags := readDataSource(t, p, "stile_buildkite_artifacts", test.raw)
+			requireNoErrors(t, diags)
+
+			paths := []string{}
+			for _, artifact := range d.Get("artifacts").([]interface{}) {
+				paths = append(paths, artifact.(map[string]interface{})["path"].(string))
+			}
+			if !reflect.DeepEqual(paths, test.wantPaths) {
+				t.Errorf("paths = %q, want %q", paths, test.wantPaths)
+			}
+			if got, want := d.Id(), "test-org/test-pipeline/5"; got != want {
+				t.Errorf("id = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestDataStileBuildkiteArtifactsReadAttributes(t *testing.T) {
+	fake := newFakeBuildkite(t)
+	body := `{"name": "prober"}`
+	fake.addArtifactAt(fake.addBuild(5), "manifests/prober.json", "job-a", body)
+	p := testProvider(t, fake)
+
+	d, diags := readDataSource(t, p, "stile_buildkite_artifacts", map[string]interface{}{
+		"build_number": 5,
+	})
+	requireNoErrors(t, diags)
+
+	want := []interface{}{
+		map[string]interface{}{
+			"id":        "artifact-5-0",
+			"filename":  "prober.json",
+			"path":      "manifests/prober.json",
+			"job_id":    "job-a",
+			"sha1sum":   fmt.Sprintf("%x", sha1.Sum([]byte(body))),
+			"file_size": len(body),
+			"state":     "finished",
+		},
+	}
+	if got := d.Get("artifacts"); !reflect.DeepEqual(got, want) {
+		t.Errorf("artifacts = %#v, want %#v", got, want)
+	}
+}
@@ -4,16 +4,15 @@ import (
 	"bytes"
 	"context"
 	"crypto/sha256"
-	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
+	"io/ioutil"
 	"log"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 
-	"github.com/buildkite/go-buildkite/v2/buildkite"
 	"github.com/hashicorp/terraform-plugin-sdk/v2/diag"
 	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
 )
@@ -21,12 +20,42 @@ import (
 type diagnosticError struct {
 	summary string
 	detail  string
+	// The underlying error, if any, so callers can still tell what
+	// went wrong.
+	err error
 }
 
 func (e diagnosticError) Error() string {
 	return fmt.Sprintf("%s: %v", e.summary, e.detail)
 }
 
+func (e diagnosticError) Unwrap() error {
+	return e.err
+}
+
+// diagnosticsFromError does our best to give a structured diagnostic if
+// err is one of our errors. If it's just been bubbled up from a library
+// it all goes in the summary, after the given prefix.
+func diagnosticsFromError(err error, prefix string) diag.Diagnostics {
+	var diagError diagnosticError
+	if errors.As(err, &diagError) {
+		return diag.Diagnostics{
+			diag.Diagnostic{
+				Severity: diag.Error,
+				Summary:  diagError.summary,
+				Detail:   diagError.detail,
+			},
+		}
+	}
+
+	return diag.Diagnostics{
+		diag.Diagnostic{
+			Severity: diag.Error,
+			Summary:  fmt.Sprintf("%s: %v", prefix, err),
+		},
+	}
+}
+
 // NOTE: Provider Parameterized by Architecture
 //
 // This provider accepts an "architecture" input which causes it to extract
@@ -38,10 +67,24 @@ func (e diagnosticError) Error() string {
 // structure of the JSON. Accomplishing this should be easier on the newer
 // provider-API: `terraform-plugin-framework`. Future work might migrate
 // this provider to that new API.
+//
+// In the meantime every architecture is also returned in "architectures",
+// a list of blocks rather than a map, since that's the only nesting this
+// SDK supports for computed attributes. Modules that want a map can build
+// one with `{ for a in ...architectures : a.name => a }`.
+//
+// The manifest is decoded into the typed `manifest` struct before any of
+// this happens, and the schema below is only a flattening of it. A
+// migration would model that struct as framework nested attributes, with
+// this schema kept alongside it (eg: via terraform-plugin-mux) so existing
+// state still reads. Neither module is vendored yet.
 
 func dataStileManifest() *schema.Resource {
 	return &schema.Resource{
 		ReadContext: dataStileManifestRead,
+		Timeouts: &schema.ResourceTimeout{
+			Read: schema.DefaultTimeout(5 * time.Minute),
+		},
 		Schema: map[string]*schema.Schema{
 			"manifest_name": {
 				Type:     schema.TypeString,
@@ -49,10 +92,103 @@ func dataStileManifest() *schema.Resource {
 				Optional: false,
 				Computed: false,
 			},
+			// Either the build to get the manifest from, or, if commit is
+			// given instead, the build that was found for that commit.
 			"bfp_build_number": {
-				Type:     schema.TypeInt,
-				Required: true,
-				Optional: false,
+				Type:         schema.TypeInt,
+				Required:     false,
+				Optional:     true,
+				Computed:     true,
+				ExactlyOneOf: []string{"bfp_build_number", "commit", "source"},
+			},
+			// The full git SHA the manifest was built from. The most
+			// recent build of this commit that produced the manifest is
+			// used.
+			"commit": {
+				Type:         schema.TypeString,
+				Required:     false,
+				Optional:     true,
+				Computed:     false,
+				ExactlyOneOf: []string{"bfp_build_number", "commit", "source"},
+			},
+			// Where to get the manifest from, tried in order until one
+			// has it. Each block sets exactly one of:
+			//
+			//   - build_number: a Buildkite build
+			//   - commit: the latest Buildkite build of a commit
+			//   - latest_passing_branch: the latest passing Buildkite
+			//     build of a branch
+			//   - file: a file on the machine running Terraform
+			//   - url: an https:// URL
+			//   - json: the manifest itself
+			//
+			// This replaces bfp_build_number or commit, and the fallback_*
+			// arguments, which are equivalent to a chain of sources.
+			"source": {
+				Type:          schema.TypeList,
+				Optional:      true,
+				ExactlyOneOf:  []string{"bfp_build_number", "commit", "source"},
+				ConflictsWith: []string{"fallback_manifest", "fallback_build_number", "fallback_to_latest_passing"},
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"build_number": {
+							Type:     schema.TypeInt,
+							Optional: true,
+						},
+						"commit": {
+							Type:     schema.TypeString,
+							Optional: true,
+						},
+						"latest_passing_branch": {
+							Type:     schema.TypeString,
+							Optional: true,
+						},
+						"file": {
+							Type:     schema.TypeString,
+							Optional: true,
+						},
+						"url": {
+							Type:     schema.TypeString,
+							Optional: true,
+						},
+						"json": {
+							Type:     schema.TypeString,
+							Optional: true,
+						},
+					},
+				},
+			},
+			// Where builds' manifests come from, overriding the
+			// provider's manifest_source.
+			"manifest_source": {
+				Type:         schema.TypeString,
+				Optional:     true,
+				ValidateFunc: validateManifestSource,
+			},
+			// Pins the exact manifest to use: the read fails if the
+			// SHA-256 of the manifest, which is also this data source's
+			// id, is anything else.
+			"expected_sha256": {
+				Type:     schema.TypeString,
+				Optional: true,
+				Required: false,
+				Computed: false,
+			},
+			// Check the manifest's detached signature against the
+			// provider's manifest_public_keys. This always happens if
+			// the provider sets require_signed_manifests.
+			"verify_signature": {
+				Type:     schema.TypeBool,
+				Optional: true,
+				Required: false,
+				Computed: false,
+			},
+			// The artifact holding the signature, from the same build.
+			// Defaults to "<manifest_name>.sig".
+			"signature_name": {
+				Type:     schema.TypeString,
+				Optional: true,
+				Required: false,
 				Computed: false,
 			},
 			"fallback_manifest": {
@@ -61,6 +197,29 @@ func dataStileManifest() *schema.Resource {
 				Required: false,
 				Computed: false,
 			},
+			// Rather than an inline manifest, fall back to the same
+			// manifest from another build: either a specific one, or the
+			// latest passing build of fallback_branch that has it. These
+			// are tried before fallback_manifest.
+			"fallback_build_number": {
+				Type:          schema.TypeInt,
+				Optional:      true,
+				Required:      false,
+				Computed:      false,
+				ConflictsWith: []string{"fallback_to_latest_passing"},
+			},
+			"fallback_to_latest_passing": {
+				Type:     schema.TypeBool,
+				Optional: true,
+				Required: false,
+				Computed: false,
+			},
+			"fallback_branch": {
+				Type:     schema.TypeString,
+				Optional: true,
+				Required: false,
+				Computed: false,
+			},
 			// Which architecture should we return images/AMIs for? The
 			// exact format for this string is unspecified and simply
 			// corresponds with whatever the manifest provider has placed
@@ -72,6 +231,34 @@ func dataStileManifest() *schema.Resource {
 				Optional: true,
 				Required: false,
 			},
+			// AMIs in the manifest can be qualified by region, eg:
+			// "base-ami:ap-southeast-2". If a region is given then
+			// "amis" holds just the AMIs for that region, keyed by their
+			// unqualified names, using the unqualified AMI where there's
+			// no region-specific one.
+			"region": {
+				Type:     schema.TypeString,
+				Optional: true,
+				Required: false,
+				Computed: false,
+			},
+			// Keys that must be in "service_versions" and "amis" (after
+			// picking the architecture and region), so a build that
+			// drops one fails here rather than wherever it's used.
+			"required_service_versions": {
+				Type:     schema.TypeList,
+				Optional: true,
+				Elem: &schema.Schema{
+					Type: schema.TypeString,
+				},
+			},
+			"required_amis": {
+				Type:     schema.TypeList,
+				Optional: true,
+				Elem: &schema.Schema{
+					Type: schema.TypeString,
+				},
+			},
 			"name": {
 				Type:     schema.TypeString,
 				Computed: true,
@@ -80,6 +267,27 @@ func dataStileManifest() *schema.Resource {
 				Type:     schema.TypeMap,
 				Computed: true,
 			},
+			// The "amis" for every region mentioned in the manifest,
+			// sorted by region.
+			"amis_by_region": {
+				Type:     schema.TypeList,
+				Computed: true,
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"region": {
+							Type:     schema.TypeString,
+							Computed: true,
+						},
+						"amis": {
+							Type:     schema.TypeMap,
+							Computed: true,
+							Elem: &schema.Schema{
+								Type: schema.TypeString,
+							},
+						},
+					},
+				},
+			},
 			"service_versions": {
 				Type:     schema.TypeMap,
 				Computed: true,
@@ -87,170 +295,226 @@ func dataStileManifest() *schema.Resource {
 					Type: schema.TypeString,
 				},
 			},
-			// This value is needed to keep terraform application's
-			// idempotent. If a manifest becomes available after we've
-			// applied the terraform then subsequent applications of
-			// the terraform would say there is a diff when we don't
-			// want them to.
-			"used_fallback_manifest": {
+			// Every architecture in the manifest, sorted by name.
+			"architectures": {
+				Type:     schema.TypeList,
+				Computed: true,
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"name": {
+							Type:     schema.TypeString,
+							Computed: true,
+						},
+						"amis": {
+							Type:     schema.TypeMap,
+							Computed: true,
+							Elem: &schema.Schema{
+								Type: schema.TypeString,
+							},
+						},
+						"service_versions": {
+							Type:     schema.TypeMap,
+							Computed: true,
+							Elem: &schema.Schema{
+								Type: schema.TypeString,
+							},
+						},
+					},
+				},
+			},
+			"available_architectures": {
+				Type:     schema.TypeList,
+				Computed: true,
+				Elem: &schema.Schema{
+					Type: schema.TypeString,
+				},
+			},
+			// Repository URL to the SHA it was built from.
+			"commits": {
+				Type:     schema.TypeMap,
+				Computed: true,
+				Elem: &schema.Schema{
+					Type: schema.TypeString,
+				},
+			},
+			// The whole manifest, for fields not otherwise modelled
+			// here. It's re-encoded with sorted keys and no whitespace so
+			// it only changes when the manifest's contents do.
+			"manifest_json": {
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+			"signature_verified": {
 				Type:     schema.TypeBool,
 				Computed: true,
 			},
-		},
-	}
-}
-
-func getBuildkiteArtifact(apiToken string, artifactName string, buildNumber string, pipeline string, org string) (io.Reader, error) {
-	config, err := buildkite.NewTokenConfig(apiToken, true)
-
-	if err != nil {
-		log.Printf("client config failed: %s", err)
-		return nil, diagnosticError{
-			summary: "Unable to configure Buildkite Client with BUILDKITE_READ_API_TOKEN",
-			detail:  fmt.Sprintf("client config failed: %v", err),
-		}
-	}
-
-	client := buildkite.NewClient(config.Client())
-
-	// This is a pointer, so for ease of use we assign it with the default
-	// values for the structure. If we used the, the perhaps more
-	// idiomatic, `var` then `opts` would be nil and we'd have to special
-	// case setting `Page` for the first iteration of the loop where it
-	// would be `nil`
-	opts := &buildkite.ArtifactListOptions{ListOptions: buildkite.ListOptions{}}
-
-	// Buildkite's Artifacts API is paginated so we need to go through each
-	// page until we find the artifact we're looking for, or run out of
-	// pages.
-	for {
-		artifacts, response, err := client.Artifacts.ListByBuild(org, pipeline, buildNumber, opts)
-
-		if err != nil {
-			log.Printf("list artifacts failed: %s", err)
-			return nil, diagnosticError{
-				summary: fmt.Sprintf("Unable to list buildkite artifacts for build %s in pipeline %s/%s", buildNumber, org, pipeline),
-				detail: fmt.Sprintf(
-					"This can mean the artifact does not exist or your Buildkite API token has insufficient permission to access it: %v",
-					err,
-				),
-			}
-		}
-
-		for _, artifact := range artifacts {
-			if artifactName == "" {
-				data, err := json.MarshalIndent(artifact, "", "\t")
-				if err != nil {
-					log.Printf("json encode failed: %s", err)
-					return nil, diagnosticError{
-						summary: "Failed to encode artifact as JSON",
-						detail:  err.Error(),
+			// Which source the manifest came from: its kind, one of
+			// "build", "latest_passing_build", "file", "url" or "json",
+			// and its index in the source blocks. Builds' manifests come
+			// from manifest_source, whether that's Buildkite, a
+			// directory or S3. Without source
+			// blocks the index is into the equivalent chain: the build or
+			// commit, then fallback_build_number or
+			// fallback_to_latest_passing, then fallback_manifest.
+			"resolved_source": {
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+			"resolved_source_index": {
+				Type:     schema.TypeInt,
+				Computed: true,
+			},
+			// The build the manifest actually came from, which differs
+			// from bfp_build_number if we fell back to another build. It's
+			// 0 if fallback_manifest was used.
+			"resolved_build_number": {
+				Type:     schema.TypeInt,
+				Computed: true,
+			},
+			// Whether to keep using a fallback once it's been used, so
+			// that plans stay stable when the manifest turns up. Which
+			// fallback was used is remembered in the provider's
+			// cache_dir, as Terraform doesn't give data sources their
+			// previous state, so without one every read looks for the
+			// manifest again whatever this says:
+			//
+			//   - "never" keeps the fallback, never looking for the
+			//     manifest in earlier sources again.
+			//   - "always" looks for it on every read.
+			//   - "after_duration" looks again once the fallback has been
+			//     used for refresh_fallback_after, eg: "24h".
+			"refresh_fallback": {
+				Type:     schema.TypeString,
+				Optional: true,
+				Default:  refreshFallbackNever,
+				ValidateFunc: func(v interface{}, k string) ([]string, []error) {
+					switch v.(string) {
+					case refreshFallbackNever, refreshFallbackAlways, refreshFallbackAfterDuration:
+						return nil, nil
 					}
-				}
-				fmt.Fprintf(os.Stdout, "%s\n", string(data))
-			} else if artifactName == *artifact.Filename || artifactName == *artifact.ID {
-				var buf bytes.Buffer
-				_, err := client.Artifacts.DownloadArtifactByURL(*artifact.DownloadURL, &buf)
-				if err != nil {
-					log.Printf("DownloadArtifactByURL failed: %s", err)
-					return nil, diagnosticError{
-						summary: fmt.Sprintf("Unable to download artifact at URL %s", err),
-						detail:  fmt.Sprintf("DownloadArtifactByURL failed: %s\nAre you on the VPN?", err),
+					return nil, []error{fmt.Errorf("%q must be one of %q, %q or %q, got %q", k, refreshFallbackNever, refreshFallbackAlways, refreshFallbackAfterDuration, v.(string))}
+				},
+			},
+			"refresh_fallback_after": {
+				Type:     schema.TypeString,
+				Optional: true,
+				ValidateFunc: func(v interface{}, k string) ([]string, []error) {
+					if _, err := time.ParseDuration(v.(string)); err != nil {
+						return nil, []error{fmt.Errorf("%q must be a duration, eg: \"24h\": %v", k, err)}
 					}
-				}
-
-				return &buf, nil
-			}
-		}
-
-		// This indicates that there are no more pages to look at and
-		// we haven't found the manifest we're looking for.
-		if response.NextPage == 0 {
-			break
-		}
-
-		opts.Page = response.NextPage
+					return nil, nil
+				},
+			},
+			// When the fallback currently in use was first used, in
+			// RFC 3339 format. Empty if no fallback is in use, or there's
+			// no cache_dir to remember it in.
+			"fallback_used_at": {
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+			// Whether the manifest came from a fallback rather than the
+			// first source.
+			"used_fallback_manifest": {
+				Type:     schema.TypeBool,
+				Computed: true,
+			},
+		},
 	}
-	log.Printf("Could not find manifest %s for build number %s in %s/%s", artifactName, buildNumber, org, pipeline)
-	return nil, nil
 }
 
 func dataStileManifestRead(ctx context.Context, d *schema.ResourceData, m interface{}) diag.Diagnostics {
 	// Warning or errors can be collected in a slice type
 	var diags diag.Diagnostics
 
-	apiToken, present := os.LookupEnv("BUILDKITE_READ_API_TOKEN")
+	c := m.(*stileClient)
+
+	manifestName := d.Get("manifest_name").(string)
+
+	// Where builds' manifests come from, which is the provider's unless
+	// this data source says otherwise.
+	source := c.manifestSource
+	if spec := d.Get("manifest_source").(string); spec != "" {
+		source, _ = parseManifestSource(c, spec)
+	}
 
-	if !present {
+	chain, err := manifestChain(d)
+	if err != nil {
 		diags = append(diags, diag.Diagnostic{
 			Severity: diag.Error,
-			Summary:  "Unable to find BUILDKITE_READ_API_TOKEN environment variable.",
-			Detail:   "BUILDKITE_READ_API_TOKEN not present in environment",
+			Summary:  "Invalid manifest source",
+			Detail:   err.Error(),
 		})
-
 		return diags
 	}
 
-	manifestName := d.Get("manifest_name").(string)
-	bfpBuildNumber := strconv.Itoa(d.Get("bfp_build_number").(int))
-	org := "stile-education"
-	pipeline := "big-friendly-pipeline"
-
-	var artifact io.Reader
-
-	// Using `GetChange`, rather than the usual `Get`, is needed
-	// because data resources don't get given the terraform state in
-	// the `ResourceData` struct they're called with. This means that
-	// `used_fallback_manifest` would always be false. They are,
-	// however, given the terraform diff which we can get the
-	// `used_fallback_manifest` value from if in a previous run we used
-	// the fallback manifest.
-	_, usedFallbackManifest := d.GetChange("used_fallback_manifest")
-
-	// Only get the manifest artifact from buildkite if we haven't
-	// previously used the fallback manifest. It would just be a
-	// thrown away next anyway.
-	if !usedFallbackManifest.(bool) {
-		var err error
-		// A bit of retry. Don't add too much because it'll make legit
-		// failures take a really long time to surface. When Terraform
-		// is running this provider the user doesn't see any logs, so
-		// it will just appear that the provider is hanging and
-		// hanging and hanging...
-		for i := 0; i < 5; i++ {
-			artifact, err = getBuildkiteArtifact(apiToken, manifestName, bfpBuildNumber, pipeline, org)
-			if err == nil {
+	// Terraform doesn't give data sources the state from their last read,
+	// so the fallback that was used last time is kept in cache_dir. It's
+	// keyed by what we're looking for, and the fallback is found again by
+	// what it is rather than where it is, so that reordering the sources
+	// doesn't pin to a different one. Without a cache_dir every read
+	// starts from the first source.
+	pinKey := fmt.Sprintf("%s/%s/%s/%s", c.org, c.pipeline, manifestName, chain[0].key())
+	var pin *fallbackPin
+	if c.cache != nil {
+		pin, err = c.cache.getPin(pinKey)
+		if err != nil {
+			log.Printf("[WARN] Unable to read the fallback pinned for manifest %s: %v", manifestName, err)
+		}
+	}
+	pinnedIndex := 0
+	if pin != nil {
+		for i := 1; i < len(chain); i++ {
+			if chain[i].key() == pin.Source {
+				pinnedIndex = i
 				break
 			}
-			log.Printf("Getting manifest failed, trying again...")
-			time.Sleep(5 * time.Second)
 		}
+	}
 
-		// Do our best to give a structured diagnostic if it's one of our
-		// errors. If it's just been bubbled up from a library just put it
-		// all in the summary.
-		var diagError diagnosticError
-		if errors.As(err, &diagError) {
-			diags = append(diags, diag.Diagnostic{
-				Severity: diag.Error,
-				Summary:  diagError.summary,
-				Detail:   diagError.detail,
-			})
-		} else if err != nil {
-			diags = append(diags, diag.Diagnostic{
-				Severity: diag.Error,
-				Summary:  fmt.Sprintf("Failed to get Buildkite artifact: %v", err),
-			})
-			return diags
+	var fallbackUsedAt time.Time
+	if pinnedIndex > 0 {
+		fallbackUsedAt = pin.UsedAt
+	}
+
+	// Whether to stick with the fallback we used last time, according to
+	// refresh_fallback.
+	pinned := false
+	refreshed := false
+	if pinnedIndex > 0 {
+		switch d.Get("refresh_fallback").(string) {
+		case refreshFallbackNever:
+			pinned = true
+		case refreshFallbackAfterDuration:
+			refreshAfter, err := time.ParseDuration(d.Get("refresh_fallback_after").(string))
+			if err != nil {
+				diags = append(diags, diag.Diagnostic{
+					Severity: diag.Error,
+					Summary:  "refresh_fallback = \"after_duration\" needs a refresh_fallback_after",
+					Detail:   "Set refresh_fallback_after to how long to keep using a fallback before looking for the manifest again, eg: \"24h\".",
+				})
+				return diags
+			}
+			pinned = !fallbackUsedAt.IsZero() && time.Since(fallbackUsedAt) < refreshAfter
+			refreshed = !pinned
 		}
 	}
 
-	// This will be nil in two cases:
-	//
-	// 1. On the first application if we can't find the manifest
-	// 2. On subsequent applications if we used the fallback manifest last time.
-	if artifact == nil {
-		if fallbackArtifact, ok := d.GetOk("fallback_manifest"); ok {
+	// If we're sticking with a fallback then start from it, rather than
+	// getting manifests that would just be thrown away next anyway.
+	start := 0
+	if pinned {
+		start = pinnedIndex
+	}
+
+	// When we're given a commit rather than a build number we don't
+	// know the build number until we've found the build.
+	bfpBuildNumber := chain[0].buildNumber
+
+	var fetched *fetchedManifest
+	var sourceIndex int
+	var notFound []string
+	for i := start; i < len(chain); i++ {
+		if i > 0 {
 			if noFallback, ok := os.LookupEnv("STILE_MANIFEST_NO_FALLBACK"); ok {
 				noFallback, err := strconv.ParseBool(noFallback)
 				if err != nil {
@@ -264,90 +528,226 @@ func dataStileManifestRead(ctx context.Context, d *schema.ResourceData, m interf
 				if noFallback {
 					diags = append(diags, diag.Diagnostic{
 						Severity: diag.Error,
-						Summary:  fmt.Sprintf("Manifest %s not found for build %s in %s/%s", manifestName, bfpBuildNumber, org, pipeline),
-						Detail:   "This may be because the build failed or it is on a branch that does not build the manifest. You can use fallback_manifest to specify a map of the manifest that should be used if the expected one does not exist. A fallback was specified via fallback_manifest but fallback was disabled via the STILE_MANIFEST_NO_FALLBACK environment variable.",
+						Summary:  fmt.Sprintf("Manifest %s not found for %s", manifestName, describeNotFound(notFound)),
+						Detail:   "This may be because the build failed or it is on a branch that does not build the manifest. A fallback was specified but fallback was disabled via the STILE_MANIFEST_NO_FALLBACK environment variable.",
 					})
 					return diags
 				}
-				// If we haven't disabled fallback, just warn that
-				// we're falling back.
-				diags = append(diags, diag.Diagnostic{
-					Severity: diag.Warning,
-					Summary:  fmt.Sprintf("Manifest %s not found for build %s in %s/%s, using fallback", manifestName, bfpBuildNumber, org, pipeline),
-					Detail:   "This may be because the build failed or it is on a branch that does not build the manifest. You can use fallback_manifest to specify a map of the manifest that should be used if the expected one does not exist. However, a fallback was specifie.",
-				})
 			}
+		}
 
-			var buf bytes.Buffer
-			if _, err := buf.WriteString(fallbackArtifact.(string)); err != nil {
-				diags = append(diags, diag.FromErr(err)...)
-			}
-			artifact = &buf
-			d.Set("used_fallback_manifest", true)
-		} else {
-			diags = append(diags, diag.Diagnostic{
-				Severity: diag.Error,
-				Summary:  fmt.Sprintf("Manifest %s not found for build %s in %s/%s", manifestName, bfpBuildNumber, org, pipeline),
-				Detail:   "This may be because the build failed or it is on a branch that does not build the manifest. You can use fallback_manifest to specify a map of the manifest that should be used if the expected one does not exist.",
-			})
-			return diags
+		// Stick with the build we fell back to last time, for the same
+		// reason we stick with the fallback at all. Otherwise the
+		// latest passing build could change under us.
+		pinnedBuildNumber := 0
+		if i == start && pinned {
+			pinnedBuildNumber = pin.BuildNumber
 		}
+
+		result, description, fetchDiags := fetchManifestChainEntry(ctx, c, chain[i], source, manifestName, pinnedBuildNumber)
+		if i == 0 && result != nil && result.buildNumber != "" {
+			bfpBuildNumber, _ = strconv.Atoi(result.buildNumber)
+		}
+		if fetchDiags.HasError() {
+			return append(diags, fetchDiags...)
+		}
+
+		if result != nil && result.body != nil {
+			fetched = result
+			sourceIndex = i
+			break
+		}
+		notFound = append(notFound, description)
+	}
+
+	if fetched == nil {
+		diags = append(diags, diag.Diagnostic{
+			Severity: diag.Error,
+			Summary:  fmt.Sprintf("Manifest %s not found for %s", manifestName, describeNotFound(notFound)),
+			Detail:   "This may be because the build failed or it is on a branch that does not build the manifest. You can use source blocks, or fallback_build_number, fallback_to_latest_passing or fallback_manifest, to specify the manifest that should be used if the expected one does not exist.",
+		})
+		return diags
 	}
 
-	var buf bytes.Buffer
-	tee := io.TeeReader(artifact, &buf)
+	if len(notFound) != 0 && sourceIndex > 0 {
+		detail := "This may be because the build failed or it is on a branch that does not build the manifest."
+		if c.cache == nil && d.Get("refresh_fallback").(string) != refreshFallbackAlways {
+			detail += " The fallback can't be kept for later reads without a cache_dir to remember it in, so the manifest will be looked for again next time."
+		}
+		diags = append(diags, diag.Diagnostic{
+			Severity: diag.Warning,
+			Summary:  fmt.Sprintf("Manifest %s not found for %s, using the one from %s", manifestName, describeNotFound(notFound), fetched.description),
+			Detail:   detail,
+		})
+	}
 
-	manifest := map[string]interface{}{}
-	err := json.NewDecoder(artifact).Decode(&manifest)
-	if err != nil {
+	if err := d.Set("used_fallback_manifest", sourceIndex > 0); err != nil {
 		return diag.FromErr(err)
 	}
 
-	var arch = d.Get("architecture").(string)
-	if arch == "" {
-		// No target architecture was specified by the user so just grab
-		// the top-level fields which don't commit to a specific
-		// architecture.
-		if err := d.Set("amis", manifest["amis"]); err != nil {
-			return diag.FromErr(err)
+	// Keep the time we first fell back for as long as we keep falling
+	// back to the same place, unless we've just looked for the manifest
+	// again, so that after_duration waits another refresh_fallback_after.
+	resolvedBuildNumber := 0
+	if fetched.buildNumber != "" {
+		resolvedBuildNumber, _ = strconv.Atoi(fetched.buildNumber)
+	}
+	usedAt := ""
+	if c.cache != nil {
+		if sourceIndex > 0 {
+			if fallbackUsedAt.IsZero() || refreshed || sourceIndex != pinnedIndex || pin.BuildNumber != resolvedBuildNumber {
+				fallbackUsedAt = time.Now().UTC()
+			}
+			usedAt = fallbackUsedAt.Format(time.RFC3339)
+
+			err = c.cache.putPin(pinKey, fallbackPin{Source: chain[sourceIndex].key(), BuildNumber: resolvedBuildNumber, UsedAt: fallbackUsedAt})
+		} else {
+			err = c.cache.deletePin(pinKey)
 		}
-		if err := d.Set("service_versions", manifest["service_versions"]); err != nil {
-			return diag.FromErr(err)
+		if err != nil {
+			log.Printf("[WARN] Unable to pin the fallback for manifest %s: %v", manifestName, err)
 		}
-	} else {
-		archData, ok := manifest[arch]
-		if !ok {
-			diags = append(diags, diag.Diagnostic{
-				Severity: diag.Error,
-				Summary:  fmt.Sprintf("No entry for architecture %q in the manifest", arch),
-				Detail:   fmt.Sprintf("This is most likely due to the %q manifest not being of kind 'Manifest'. Add `output_kind: Manifest` to the product definition to fix this.", manifestName),
-			})
-			return diags
+	}
+	if err := d.Set("fallback_used_at", usedAt); err != nil {
+		return diag.FromErr(err)
+	}
+
+	if pinned && sourceIndex == start {
+		detail := "The manifest's earlier sources aren't checked again while a fallback is in use, so a manifest that has appeared since won't be used. Set refresh_fallback to \"always\" or \"after_duration\" to look for it again."
+		if d.Get("refresh_fallback").(string) == refreshFallbackAfterDuration {
+			detail = fmt.Sprintf("The manifest's earlier sources will be checked again once the fallback has been used for %s.", d.Get("refresh_fallback_after"))
 		}
+		diags = append(diags, diag.Diagnostic{
+			Severity: diag.Warning,
+			Summary:  fmt.Sprintf("Manifest %s is still pinned to the fallback from %s, used since %s", manifestName, fetched.description, usedAt),
+			Detail:   detail,
+		})
+	}
+
+	artifact := fetched.body
+	buildDescription := fetched.description
+	// Only manifests from a build can have their signatures checked.
+	sourceBuildNumber := fetched.buildNumber
+
+	raw, err := ioutil.ReadAll(artifact)
+	if err != nil {
+		return diag.FromErr(err)
+	}
+
+	sum := fmt.Sprintf("%x", sha256.Sum256(raw))
+
+	if expected, ok := d.GetOk("expected_sha256"); ok && !strings.EqualFold(expected.(string), sum) {
+		diags = append(diags, diag.Diagnostic{
+			Severity: diag.Error,
+			Summary:  fmt.Sprintf("Manifest %s for %s doesn't match expected_sha256", manifestName, buildDescription),
+			Detail:   fmt.Sprintf("Expected SHA-256 %s, got %s. Either the manifest has changed or expected_sha256 needs updating.", expected, sum),
+		})
+		return diags
+	}
 
-		items, ok := archData.(map[string]interface{})
-		if !ok {
+	signatureVerified := false
+	if c.requireSignedManifests || d.Get("verify_signature").(bool) {
+		if sourceBuildNumber != "" {
+			if verifyDiags := verifyFetchedManifest(ctx, c, fetched, manifestName, d.Get("signature_name").(string), raw); verifyDiags.HasError() {
+				return append(diags, verifyDiags...)
+			}
+			signatureVerified = true
+		} else {
+			// Asking for a signature and not getting one has to fail,
+			// however the manifest was found.
+			detail := "verify_signature is set, and only manifests from a build are signed."
+			if c.requireSignedManifests {
+				detail = "require_signed_manifests is set in the provider block, and only manifests from a build are signed."
+			}
 			diags = append(diags, diag.Diagnostic{
 				Severity: diag.Error,
-				Summary: fmt.Sprintf(
-					"Entry for architecture %q in the manifest didn't have expected type `map[string]interface{}`, got `%T`",
-					arch,
-					archData,
-				),
-				Detail: "This is most likely due to the manifest being malformd. Check the manifest JSON in buildkite and fix the `create_untested_manifest` Rake task in buildkite/Rakefile is necessary.",
+				Summary:  fmt.Sprintf("Can't use manifest %s from %s", manifestName, buildDescription),
+				Detail:   detail,
 			})
 			return diags
 		}
+	}
+
+	var arch = d.Get("architecture").(string)
+
+	// Validate the whole manifest before setting anything from it, so a
+	// malformed one fails loudly rather than leaving some attributes empty.
+	manifest, items, decodeDiags := decodeFetchedManifest(raw, arch, manifestName, fetched)
+	if decodeDiags.HasError() {
+		return append(diags, decodeDiags...)
+	}
+	amis := items.AMIs
+	serviceVersions := items.ServiceVersions
+
+	if err := d.Set("signature_verified", signatureVerified); err != nil {
+		return diag.FromErr(err)
+	}
 
-		if err := d.Set("amis", items["amis"]); err != nil {
-			return diag.FromErr(err)
+	selectedAMIs := amis
+	if region := d.Get("region").(string); region != "" {
+		selectedAMIs = resolveRegionalAMIs(amis, region)
+	}
+
+	// Fail here, naming everything that's missing, rather than with an
+	// "invalid index" wherever the module happens to use it.
+	var missing []string
+	for _, key := range d.Get("required_service_versions").([]interface{}) {
+		if _, ok := serviceVersions[key.(string)]; !ok {
+			missing = append(missing, fmt.Sprintf("service_versions[%q]", key))
+		}
+	}
+	for _, key := range d.Get("required_amis").([]interface{}) {
+		if _, ok := selectedAMIs[key.(string)]; !ok {
+			missing = append(missing, fmt.Sprintf("amis[%q]", key))
 		}
-		if err := d.Set("service_versions", items["service_versions"]); err != nil {
-			return diag.FromErr(err)
+	}
+	if len(missing) != 0 {
+		where := "the top level of the manifest"
+		if arch != "" {
+			where = fmt.Sprintf("architecture %q", arch)
 		}
+		diags = append(diags, diag.Diagnostic{
+			Severity: diag.Error,
+			Summary:  fmt.Sprintf("Manifest %s for %s is missing required keys", manifestName, buildDescription),
+			Detail:   fmt.Sprintf("These keys were required but aren't in %s: %s.", where, strings.Join(missing, ", ")),
+		})
+		return diags
+	}
+
+	if err := d.Set("service_versions", serviceVersions); err != nil {
+		return diag.FromErr(err)
+	}
+
+	if err := d.Set("amis", selectedAMIs); err != nil {
+		return diag.FromErr(err)
+	}
+
+	var amisByRegion []interface{}
+	for _, region := range amiRegions(amis) {
+		amisByRegion = append(amisByRegion, map[string]interface{}{
+			"region": region,
+			"amis":   resolveRegionalAMIs(amis, region),
+		})
+	}
+	if err := d.Set("amis_by_region", amisByRegion); err != nil {
+		return diag.FromErr(err)
+	}
+
+	// This is only unknown if we couldn't find a build for the commit,
+	// or the manifest doesn't come from Buildkite at all.
+	if err := d.Set("bfp_build_number", bfpBuildNumber); err != nil {
+		return diag.FromErr(err)
+	}
+
+	if err := d.Set("resolved_build_number", resolvedBuildNumber); err != nil {
+		return diag.FromErr(err)
 	}
 
-	if err := d.Set("bfp_build_number", d.Get("bfp_build_number").(int)); err != nil {
+	if err := d.Set("resolved_source", chain[sourceIndex].kind()); err != nil {
+		return diag.FromErr(err)
+	}
+
+	if err := d.Set("resolved_source_index", sourceIndex); err != nil {
 		return diag.FromErr(err)
 	}
 
@@ -355,18 +755,212 @@ func dataStileManifestRead(ctx context.Context, d *schema.ResourceData, m interf
 		return diag.FromErr(err)
 	}
 
-	if err := d.Set("name", manifest["name"]); err != nil {
+	if err := d.Set("name", manifest.Name); err != nil {
+		return diag.FromErr(err)
+	}
+
+	availableArchitectures := manifest.architectureNames()
+	if err := d.Set("available_architectures", availableArchitectures); err != nil {
+		return diag.FromErr(err)
+	}
+
+	architectures := make([]interface{}, 0, len(availableArchitectures))
+	for _, name := range availableArchitectures {
+		items := manifest.Architectures[name]
+		architectures = append(architectures, map[string]interface{}{
+			"name":             name,
+			"amis":             items.AMIs,
+			"service_versions": items.ServiceVersions,
+		})
+	}
+	if err := d.Set("architectures", architectures); err != nil {
 		return diag.FromErr(err)
 	}
 
-	h := sha256.New()
-	if _, err := io.Copy(h, tee); err != nil {
+	if err := d.Set("commits", manifest.Commits); err != nil {
 		return diag.FromErr(err)
 	}
 
-	sum := h.Sum(nil)
+	manifestJSON, err := manifest.canonicalJSON()
+	if err != nil {
+		return diag.FromErr(err)
+	}
+	if err := d.Set("manifest_json", manifestJSON); err != nil {
+		return diag.FromErr(err)
+	}
 
-	d.SetId(fmt.Sprintf("%x", sum))
+	d.SetId(sum)
 
 	return diags
 }
+
+// The values of refresh_fallback.
+const (
+	refreshFallbackNever         = "never"
+	refreshFallbackAlways        = "always"
+	refreshFallbackAfterDuration = "after_duration"
+)
+
+// fetchManifestChainEntry fetches the manifest e points to, as e.fetch
+// does, with any error as diagnostics. It's shared with
+// stile_manifest_diff so that both fail the same way.
+func fetchManifestChainEntry(ctx context.Context, c *stileClient, e manifestChainEntry, source ManifestSource, manifestName string, pinnedBuildNumber int) (*fetchedManifest, string, diag.Diagnostics) {
+	var diags diag.Diagnostics
+
+	fetched, description, err := e.fetch(ctx, c, source, manifestName, pinnedBuildNumber)
+	// Either Terraform was interrupted or we hit the read timeout.
+	// Neither should be papered over with a fallback.
+	if isContextError(err) {
+		diags = append(diags, diag.Diagnostic{
+			Severity: diag.Error,
+			Summary:  fmt.Sprintf("Gave up fetching manifest %s for %s", manifestName, description),
+			Detail:   fmt.Sprintf("%v. If Buildkite is just slow the read timeout can be raised with a `timeouts { read = ... }` block.", err),
+		})
+		return fetched, description, diags
+	}
+	if err != nil {
+		return fetched, description, diagnosticsFromError(err, "Failed to get Buildkite artifact")
+	}
+
+	return fetched, description, nil
+}
+
+// verifyFetchedManifest checks raw, the manifest fetched from a build,
+// against the signature uploaded alongside it. signatureName defaults to
+// the manifest's name with ".sig" added.
+func verifyFetchedManifest(ctx context.Context, c *stileClient, fetched *fetchedManifest, manifestName string, signatureName string, raw []byte) diag.Diagnostics {
+	var diags diag.Diagnostics
+
+	if signatureName == "" {
+		signatureName = manifestName + ".sig"
+	}
+
+	signature, err := fetched.source.FetchManifest(ctx, fetched.buildNumber, signatureName)
+	if err != nil {
+		return diagnosticsFromError(err, "Failed to get manifest signature")
+	}
+	if signature == nil {
+		diags = append(diags, diag.Diagnostic{
+			Severity: diag.Error,
+			Summary:  fmt.Sprintf("Signature %s for manifest %s not found for %s", signatureName, manifestName, fetched.description),
+			Detail:   "The manifest's signature must be uploaded as an artifact of the same build.",
+		})
+		return diags
+	}
+
+	signatureBytes, err := ioutil.ReadAll(signature)
+	if err != nil {
+		return diag.FromErr(err)
+	}
+
+	if err := verifyManifestSignature(c.manifestPublicKeys, raw, signatureBytes); err != nil {
+		diags = append(diags, diag.Diagnostic{
+			Severity: diag.Error,
+			Summary:  fmt.Sprintf("Manifest %s for %s failed signature verification", manifestName, fetched.description),
+			Detail:   fmt.Sprintf("%v. The manifest hasn't been used.", err),
+		})
+		return diags
+	}
+
+	return nil
+}
+
+// decodeFetchedManifest decodes and validates raw, the manifest fetched
+// from wherever fetched says, returning it along with the maps for arch,
+// or its top-level maps if arch is empty.
+func decodeFetchedManifest(raw []byte, arch string, manifestName string, fetched *fetchedManifest) (*manifest, manifestArchitecture, diag.Diagnostics) {
+	var diags diag.Diagnostics
+
+	manifest, err := decodeManifest(bytes.NewReader(raw), arch)
+	if err != nil {
+		var validationErr *manifestValidationError
+		if !errors.As(err, &validationErr) {
+			return nil, manifestArchitecture{}, diag.FromErr(err)
+		}
+
+		detail := "Check the manifest JSON in buildkite and fix the `create_untested_manifest` Rake task in buildkite/Rakefile if necessary."
+		if fetched.buildNumber == "" {
+			detail = "Check the manifest's source."
+		}
+		for _, problem := range validationErr.problems {
+			diags = append(diags, diag.Diagnostic{
+				Severity: diag.Error,
+				Summary:  fmt.Sprintf("Manifest %s for %s is invalid: %s", manifestName, fetched.description, problem),
+				Detail:   detail,
+			})
+		}
+		return nil, manifestArchitecture{}, diags
+	}
+
+	if arch == "" {
+		// No target architecture was specified by the user so just grab
+		// the top-level fields which don't commit to a specific
+		// architecture.
+		return manifest, manifestArchitecture{AMIs: manifest.AMIs, ServiceVersions: manifest.ServiceVersions}, nil
+	}
+
+	items, ok := manifest.Architectures[arch]
+	if !ok {
+		diags = append(diags, diag.Diagnostic{
+			Severity: diag.Error,
+			Summary:  fmt.Sprintf("No entry for architecture %q in manifest %s for %s", arch, manifestName, fetched.description),
+			Detail:   fmt.Sprintf("This is most likely due to the %q manifest not being of kind 'Manifest'. Add `output_kind: Manifest` to the product definition to fix this.", manifestName),
+		})
+		return nil, manifestArchitecture{}, diags
+	}
+
+	return manifest, items, nil
+}
+
+// manifestChain returns the sources stile_manifest should try, in order.
+// These are the "source" blocks if there are any, otherwise the chain
+// implied by the older arguments.
+func manifestChain(d *schema.ResourceData) ([]manifestChainEntry, error) {
+	if blocks := d.Get("source").([]interface{}); len(blocks) != 0 {
+		chain := make([]manifestChainEntry, 0, len(blocks))
+		for i, block := range blocks {
+			// An empty block comes through as nil.
+			fields, _ := block.(map[string]interface{})
+			if fields == nil {
+				return nil, fmt.Errorf("source %d: is empty", i)
+			}
+			entry, err := manifestChainEntryFromMap(fields)
+			if err != nil {
+				return nil, fmt.Errorf("source %d: %w", i, err)
+			}
+			chain = append(chain, entry)
+		}
+		return chain, nil
+	}
+
+	chain := []manifestChainEntry{{
+		buildNumber: d.Get("bfp_build_number").(int),
+		commit:      d.Get("commit").(string),
+	}}
+
+	if fallbackBuildNumber := d.Get("fallback_build_number").(int); fallbackBuildNumber != 0 {
+		chain = append(chain, manifestChainEntry{buildNumber: fallbackBuildNumber})
+	}
+
+	if d.Get("fallback_to_latest_passing").(bool) {
+		fallbackBranch := d.Get("fallback_branch").(string)
+		if fallbackBranch == "" {
+			return nil, errors.New("fallback_to_latest_passing needs a fallback_branch, the branch whose latest passing build the manifest should come from")
+		}
+		chain = append(chain, manifestChainEntry{latestPassingBranch: fallbackBranch})
+	}
+
+	if fallbackManifest, ok := d.GetOk("fallback_manifest"); ok {
+		chain = append(chain, manifestChainEntry{json: fallbackManifest.(string)})
+	}
+
+	return chain, nil
+}
+
+// describeNotFound lists the places a manifest wasn't found.
+func describeNotFound(descriptions []string) string {
+	if len(descriptions) == 0 {
+		return "its sources before the fallback that was used previously"
+	}
+	return strings.Join(descriptions, ", or ")
+}
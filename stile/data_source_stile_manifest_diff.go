@@ -0,0 +1,243 @@
+package stile
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/hashicorp/terraform-plugin-sdk/v2/diag"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+)
+
+// dataStileManifestDiff compares a manifest from two builds, so that a plan
+// can show which services and AMIs a deploy changes, eg:
+//
+//	data "stile_manifest_diff" "prober" {
+//	  manifest_name     = "untested-prober-service-manifest.json"
+//	  from_build_number = 926993
+//	  to_build_number   = 927100
+//	  architecture      = "IntelLinux"
+//	}
+//
+//	output "changed_services" {
+//	  value = data.stile_manifest_diff.prober.changed[0].service_versions
+//	}
+func dataStileManifestDiff() *schema.Resource {
+	return &schema.Resource{
+		ReadContext: dataStileManifestDiffRead,
+		Timeouts: &schema.ResourceTimeout{
+			Read: schema.DefaultTimeout(5 * time.Minute),
+		},
+		Schema: map[string]*schema.Schema{
+			"manifest_name": {
+				Type:     schema.TypeString,
+				Required: true,
+			},
+			// Usually the build that's deployed now and the one that's
+			// about to be.
+			"from_build_number": {
+				Type:     schema.TypeInt,
+				Required: true,
+			},
+			"to_build_number": {
+				Type:     schema.TypeInt,
+				Required: true,
+			},
+			// As for stile_manifest. Without it the top-level amis and
+			// service_versions are compared.
+			"architecture": {
+				Type:     schema.TypeString,
+				Optional: true,
+			},
+			// As for stile_manifest, overriding the provider's.
+			"manifest_source": {
+				Type:         schema.TypeString,
+				Optional:     true,
+				ValidateFunc: validateManifestSource,
+			},
+			// What's only in to_build_number's manifest, with its values.
+			"added": manifestDiffSchema(),
+			// What's only in from_build_number's manifest, with its values.
+			"removed": manifestDiffSchema(),
+			// What's in both but has a different value, with the value
+			// from to_build_number. changed_from has the same keys with
+			// the values from from_build_number.
+			"changed":      manifestDiffSchema(),
+			"changed_from": manifestDiffSchema(),
+			// Whether nothing was added, removed or changed. Fields other
+			// than service_versions, amis and commits aren't compared.
+			"identical": {
+				Type:     schema.TypeBool,
+				Computed: true,
+			},
+		},
+	}
+}
+
+// manifestDiffSchema is a single block of the manifest's maps, holding
+// just the entries that differ in some way.
+func manifestDiffSchema() *schema.Schema {
+	stringMap := func() *schema.Schema {
+		return &schema.Schema{
+			Type:     schema.TypeMap,
+			Computed: true,
+			Elem: &schema.Schema{
+				Type: schema.TypeString,
+			},
+		}
+	}
+
+	return &schema.Schema{
+		Type:     schema.TypeList,
+		Computed: true,
+		Elem: &schema.Resource{
+			Schema: map[string]*schema.Schema{
+				"service_versions": stringMap(),
+				"amis":             stringMap(),
+				"commits":          stringMap(),
+			},
+		},
+	}
+}
+
+// manifestMapsDiff is how one of a manifest's maps differs between two
+// builds.
+type manifestMapsDiff struct {
+	added       map[string]string
+	removed     map[string]string
+	changed     map[string]string
+	changedFrom map[string]string
+}
+
+func diffManifestMaps(from map[string]string, to map[string]string) manifestMapsDiff {
+	diff := manifestMapsDiff{
+		added:       map[string]string{},
+		removed:     map[string]string{},
+		changed:     map[string]string{},
+		changedFrom: map[string]string{},
+	}
+
+	for key, toValue := range to {
+		fromValue, ok := from[key]
+		switch {
+		case !ok:
+			diff.added[key] = toValue
+		case fromValue != toValue:
+			diff.changed[key] = toValue
+			diff.changedFrom[key] = fromValue
+		}
+	}
+	for key, fromValue := range from {
+		if _, ok := to[key]; !ok {
+			diff.removed[key] = fromValue
+		}
+	}
+
+	return diff
+}
+
+func (diff manifestMapsDiff) empty() bool {
+	return len(diff.added) == 0 && len(diff.removed) == 0 && len(diff.changed) == 0
+}
+
+func dataStileManifestDiffRead(ctx context.Context, d *schema.ResourceData, m interface{}) diag.Diagnostics {
+	c := m.(*stileClient)
+
+	manifestName := d.Get("manifest_name").(string)
+	arch := d.Get("architecture").(string)
+
+	source := c.manifestSource
+	if spec := d.Get("manifest_source").(string); spec != "" {
+		source, _ = parseManifestSource(c, spec)
+	}
+
+	from, fromSum, diags := fetchBuildManifest(ctx, c, source, manifestName, d.Get("from_build_number").(int), arch)
+	if diags.HasError() {
+		return diags
+	}
+	to, toSum, diags := fetchBuildManifest(ctx, c, source, manifestName, d.Get("to_build_number").(int), arch)
+	if diags.HasError() {
+		return diags
+	}
+
+	diffs := map[string]manifestMapsDiff{
+		"service_versions": diffManifestMaps(from.ServiceVersions, to.ServiceVersions),
+		"amis":             diffManifestMaps(from.AMIs, to.AMIs),
+		"commits":          diffManifestMaps(from.Commits, to.Commits),
+	}
+
+	identical := true
+	added := map[string]interface{}{}
+	removed := map[string]interface{}{}
+	changed := map[string]interface{}{}
+	changedFrom := map[string]interface{}{}
+	for key, diff := range diffs {
+		identical = identical && diff.empty()
+		added[key] = diff.added
+		removed[key] = diff.removed
+		changed[key] = diff.changed
+		changedFrom[key] = diff.changedFrom
+	}
+
+	if err := d.Set("added", []interface{}{added}); err != nil {
+		return diag.FromErr(err)
+	}
+	if err := d.Set("removed", []interface{}{removed}); err != nil {
+		return diag.FromErr(err)
+	}
+	if err := d.Set("changed", []interface{}{changed}); err != nil {
+		return diag.FromErr(err)
+	}
+	if err := d.Set("changed_from", []interface{}{changedFrom}); err != nil {
+		return diag.FromErr(err)
+	}
+	if err := d.Set("identical", identical); err != nil {
+		return diag.FromErr(err)
+	}
+
+	d.SetId(fmt.Sprintf("%s:%s:%s", fromSum, toSum, arch))
+
+	return nil
+}
+
+// fetchBuildManifest gets a build's manifest the same way stile_manifest
+// does, checking its signature if the provider requires it, with the maps
+// for the given architecture (if any) at the top level, and the SHA-256 of
+// the manifest.
+func fetchBuildManifest(ctx context.Context, c *stileClient, source ManifestSource, manifestName string, buildNumber int, arch string) (*manifest, string, diag.Diagnostics) {
+	fetched, description, diags := fetchManifestChainEntry(ctx, c, manifestChainEntry{buildNumber: buildNumber}, source, manifestName, 0)
+	if diags.HasError() {
+		return nil, "", diags
+	}
+	if fetched == nil || fetched.body == nil {
+		diags = append(diags, diag.Diagnostic{
+			Severity: diag.Error,
+			Summary:  fmt.Sprintf("Manifest %s not found for %s", manifestName, description),
+			Detail:   "This may be because the build failed or it is on a branch that does not build the manifest.",
+		})
+		return nil, "", diags
+	}
+
+	raw, err := ioutil.ReadAll(fetched.body)
+	if err != nil {
+		return nil, "", diag.FromErr(err)
+	}
+	sum := fmt.Sprintf("%x", sha256.Sum256(raw))
+
+	if c.requireSignedManifests {
+		if verifyDiags := verifyFetchedManifest(ctx, c, fetched, manifestName, "", raw); verifyDiags.HasError() {
+			return nil, "", verifyDiags
+		}
+	}
+
+	manifest, items, decodeDiags := decodeFetchedManifest(raw, arch, manifestName, fetched)
+	if decodeDiags.HasError() {
+		return nil, "", decodeDiags
+	}
+	manifest.AMIs = items.AMIs
+	manifest.ServiceVersions = items.ServiceVersions
+
+	return manifest, sum, nil
+}
@@ -0,0 +1,175 @@
+package stile
+
+import (
+	"reflect"
+	"testing"
+)
+
+const testNextManifest = `{
+  "name": "927100",
+  "commits": {"git@github.com:StileEducation/stile-prober.git": "def456"},
+  "amis": {"base-ami": "ami-top"},
+  "service_versions": {"stile-prober": "prober-top"},
+  "IntelLinux": {
+    "amis": {"base-ami": "ami-intel", "nat-ami": "ami-nat-intel"},
+    "service_versions": {"stile-prober": "prober-intel-2"}
+  }
+}`
+
+func TestDiffManifestMaps(t *testing.T) {
+	diff := diffManifestMaps(
+		map[string]string{"same": "1", "changed": "1", "removed": "1"},
+		map[string]string{"same": "1", "changed": "2", "added": "1"},
+	)
+
+	want := manifestMapsDiff{
+		added:       map[string]string{"added": "1"},
+		removed:     map[string]string{"removed": "1"},
+		changed:     map[string]string{"changed": "2"},
+		changedFrom: map[string]string{"changed": "1"},
+	}
+	if !reflect.DeepEqual(diff, want) {
+		t.Errorf("diffManifestMaps = %+v, want %+v", diff, want)
+	}
+	if diff.empty() {
+		t.Error("empty() = true, want false")
+	}
+
+	if diff := diffManifestMaps(map[string]string{"same": "1"}, map[string]string{"same": "1"}); !diff.empty() {
+		t.Errorf("diffManifestMaps of equal maps = %+v, want it empty", diff)
+	}
+}
+
+func TestDataStileManifestDiffRead(t *testing.T) {
+	fake := newFakeBuildkite(t)
+	fake.addArtifact(fake.addBuild(926993), testManifestName, testManifest)
+	fake.addArtifact(fake.addBuild(927100), testManifestName, testNextManifest)
+	p := testProvider(t, fake)
+
+	d, diags := readDataSource(t, p, "stile_manifest_diff", map[string]interface{}{
+		"manifest_name":     testManifestName,
+		"from_build_number": 926993,
+		"to_build_number":   927100,
+		"architecture":      "IntelLinux",
+	})
+	requireNoErrors(t, diags)
+
+	// The commits' keys have dots in them, so the blocks are read
+	// directly rather than with paths.
+	block := func(key string) map[string]interface{} {
+		return d.Get(key).([]interface{})[0].(map[string]interface{})
+	}
+	tests := []struct {
+		key   string
+		field string
+		want  map[string]interface{}
+	}{
+		{"added", "amis", map[string]interface{}{"nat-ami": "ami-nat-intel"}},
+		{"added", "service_versions", map[string]interface{}{}},
+		{"added", "commits", map[string]interface{}{"git@github.com:StileEducation/stile-prober.git": "def456"}},
+		{"removed", "amis", map[string]interface{}{}},
+		{"removed", "commits", map[string]interface{}{"git@github.com:StileEducation/dev-environment.git": "abc123"}},
+		{"changed", "service_versions", map[string]interface{}{"stile-prober": "prober-intel-2"}},
+		{"changed", "amis", map[string]interface{}{}},
+		{"changed_from", "service_versions", map[string]interface{}{"stile-prober": "prober-intel"}},
+	}
+	for _, test := range tests {
+		if got := block(test.key)[test.field]; !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s.0.%s = %v, want %v", test.key, test.field, got, test.want)
+		}
+	}
+
+	if d.Get("identical").(bool) {
+		t.Error("identical = true, want false")
+	}
+	if got, want := d.Id(), sha256Hex(testManifest)+":"+sha256Hex(testNextManifest)+":IntelLinux"; got != want {
+		t.Errorf("id = %q, want %q", got, want)
+	}
+
+	// The top-level maps only differ by a regional AMI.
+	d, diags = readDataSource(t, p, "stile_manifest_diff", map[string]interface{}{
+		"manifest_name":     testManifestName,
+		"from_build_number": 926993,
+		"to_build_number":   927100,
+	})
+	requireNoErrors(t, diags)
+	if got, want := block("removed")["amis"], (map[string]interface{}{"base-ami:us-west-2": "ami-top-usw2"}); !reflect.DeepEqual(got, want) {
+		t.Errorf("removed.0.amis = %v, want %v", got, want)
+	}
+}
+
+func TestDataStileManifestDiffReadIdentical(t *testing.T) {
+	fake := newFakeBuildkite(t)
+	fake.addArtifact(fake.addBuild(926993), testManifestName, testManifest)
+	fake.addArtifact(fake.addBuild(927100), testManifestName, testManifest)
+	p := testProvider(t, fake)
+
+	d, diags := readDataSource(t, p, "stile_manifest_diff", map[string]interface{}{
+		"manifest_name":     testManifestName,
+		"from_build_number": 926993,
+		"to_build_number":   927100,
+		"architecture":      "GravitonLinux",
+	})
+	requireNoErrors(t, diags)
+
+	if !d.Get("identical").(bool) {
+		t.Errorf("identical = false, want true: changed = %v", d.Get("changed"))
+	}
+}
+
+func TestDataStileManifestDiffReadErrors(t *testing.T) {
+	fake := newFakeBuildkite(t)
+	fake.addArtifact(fake.addBuild(926993), testManifestName, testManifest)
+	fake.addArtifact(fake.addBuild(927100), testManifestName, testNextManifest)
+	fake.addBuild(927101)
+	p := testProvider(t, fake)
+
+	_, diags := readDataSource(t, p, "stile_manifest_diff", map[string]interface{}{
+		"manifest_name":     testManifestName,
+		"from_build_number": 926993,
+		"to_build_number":   927101,
+	})
+	requireError(t, diags, "Manifest untested-prober-service-manifest.json not found for build 927101 in test-org/test-pipeline")
+
+	_, diags = readDataSource(t, p, "stile_manifest_diff", map[string]interface{}{
+		"manifest_name":     testManifestName,
+		"from_build_number": 926993,
+		"to_build_number":   927100,
+		"architecture":      "GravitonLinux",
+	})
+	// The same as stile_manifest's.
+	requireError(t, diags, `No entry for architecture "GravitonLinux" in manifest untested-prober-service-manifest.json for build 927100 in test-org/test-pipeline`)
+}
+
+func TestDataStileManifestDiffReadSignature(t *testing.T) {
+	encodedKey, privateKey := testSigningKey(t)
+
+	fake := newFakeBuildkite(t)
+	from := fake.addBuild(926993)
+	fake.addArtifact(from, testManifestName, testManifest)
+	fake.addArtifact(from, testManifestName+".sig", signManifest(privateKey, testManifest))
+	to := fake.addBuild(927100)
+	fake.addArtifact(to, testManifestName, testNextManifest)
+	fake.addArtifact(to, testManifestName+".sig", signManifest(privateKey, testNextManifest))
+	unsigned := fake.addBuild(927101)
+	fake.addArtifact(unsigned, testManifestName, testNextManifest)
+
+	p := testProviderWithConfig(t, fake, map[string]interface{}{
+		"manifest_public_keys":     []interface{}{encodedKey},
+		"require_signed_manifests": true,
+	})
+
+	_, diags := readDataSource(t, p, "stile_manifest_diff", map[string]interface{}{
+		"manifest_name":     testManifestName,
+		"from_build_number": 926993,
+		"to_build_number":   927100,
+	})
+	requireNoErrors(t, diags)
+
+	_, diags = readDataSource(t, p, "stile_manifest_diff", map[string]interface{}{
+		"manifest_name":     testManifestName,
+		"from_build_number": 926993,
+		"to_build_number":   927101,
+	})
+	requireError(t, diags, "Signature untested-prober-service-manifest.json.sig for manifest untested-prober-service-manifest.json not found for build 927101 in test-org/test-pipeline")
+}
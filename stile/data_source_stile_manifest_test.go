@@ -0,0 +1,755 @@
+package stile
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testManifestName = "untested-prober-service-manifest.json"
+
+const testManifest = `{
+  "name": "926993",
+  "commits": {"git@github.com:StileEducation/dev-environment.git": "abc123"},
+  "amis": {"base-ami": "ami-top", "base-ami:us-west-2": "ami-top-usw2"},
+  "service_versions": {"stile-prober": "prober-top"},
+  "IntelLinux": {
+    "amis": {"base-ami": "ami-intel"},
+    "service_versions": {"stile-prober": "prober-intel"}
+  },
+  "GravitonLinux": {
+    "amis": {"base-ami": "ami-graviton"},
+    "service_versions": {"stile-prober": "prober-graviton"}
+  }
+}`
+
+const testFallbackManifest = `{"name": "fallback", "amis": {"base-ami": "ami-fallback"}, "service_versions": {"stile-prober": "prober-fallback"}}`
+
+func sha256Hex(s string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(s)))
+}
+
+func TestDataStileManifestRead(t *testing.T) {
+	fake := newFakeBuildkite(t)
+	fake.addArtifact(fake.addBuild(926993), testManifestName, testManifest)
+	p := testProvider(t, fake)
+
+	d, diags := readDataSource(t, p, "stile_manifest", map[string]interface{}{
+		"manifest_name":    testManifestName,
+		"bfp_build_number": 926993,
+	})
+	requireNoErrors(t, diags)
+
+	if got := d.Get("name"); got != "926993" {
+		t.Errorf("name = %q, want %q", got, "926993")
+	}
+	if got := d.Get("service_versions.stile-prober"); got != "prober-top" {
+		t.Errorf("service_versions[stile-prober] = %q, want %q", got, "prober-top")
+	}
+	if got := d.Get("amis.base-ami"); got != "ami-top" {
+		t.Errorf("amis[base-ami] = %q, want %q", got, "ami-top")
+	}
+	if got := d.Get("commits").(map[string]interface{})["git@github.com:StileEducation/dev-environment.git"]; got != "abc123" {
+		t.Errorf("commits = %v, want the dev-environment commit", d.Get("commits"))
+	}
+	if got := d.Get("used_fallback_manifest"); got != false {
+		t.Errorf("used_fallback_manifest = %v, want false", got)
+	}
+	if got := d.Get("resolved_build_number"); got != 926993 {
+		t.Errorf("resolved_build_number = %v, want 926993", got)
+	}
+	if got := d.Get("resolved_source"); got != manifestSourceBuild {
+		t.Errorf("resolved_source = %q, want %q", got, manifestSourceBuild)
+	}
+}
+
+func TestDataStileManifestReadPagination(t *testing.T) {
+	fake := newFakeBuildkite(t)
+	fake.perPage = 2
+	build := fake.addBuild(1)
+	for i := 0; i < 4; i++ {
+		fake.addArtifact(build, fmt.Sprintf("other-%d.json", i), "{}")
+	}
+	fake.addArtifact(build, testManifestName, testManifest)
+	p := testProvider(t, fake)
+
+	d, diags := readDataSource(t, p, "stile_manifest", map[string]interface{}{
+		"manifest_name":    testManifestName,
+		"bfp_build_number": 1,
+	})
+	requireNoErrors(t, diags)
+
+	if got := d.Get("name"); got != "926993" {
+		t.Errorf("name = %q, want %q", got, "926993")
+	}
+	if got := fake.requestCount(fake.artifactsPath(1)); got != 3 {
+		t.Errorf("listed %d pages of artifacts, want 3", got)
+	}
+}
+
+func TestDataStileManifestReadCommit(t *testing.T) {
+	fake := newFakeBuildkite(t)
+	fake.perPage = 1
+	// Two builds of the same commit, only the older of which has the
+	// manifest.
+	older := fake.addBuild(1)
+	fake.addArtifact(older, testManifestName, testManifest)
+	newer := fake.addBuild(2)
+	newer.commit = older.commit
+	fake.addBuild(3)
+	p := testProvider(t, fake)
+
+	d, diags := readDataSource(t, p, "stile_manifest", map[string]interface{}{
+		"manifest_name": testManifestName,
+		"commit":        older.commit,
+	})
+	requireNoErrors(t, diags)
+
+	if got := d.Get("bfp_build_number"); got != 1 {
+		t.Errorf("bfp_build_number = %v, want 1", got)
+	}
+	if got := d.Get("name"); got != "926993" {
+		t.Errorf("name = %q, want %q", got, "926993")
+	}
+}
+
+func TestDataStileManifestReadRetries(t *testing.T) {
+	fake := newFakeBuildkite(t)
+	build := fake.addBuild(1)
+	fake.addArtifact(build, testManifestName, testManifest)
+	fake.failNext(fake.artifactsPath(1), http.StatusBadGateway, http.StatusServiceUnavailable)
+	fake.failNext("/downloads/"+build.artifacts[0].id, http.StatusInternalServerError)
+	p := testProvider(t, fake)
+
+	_, diags := readDataSource(t, p, "stile_manifest", map[string]interface{}{
+		"manifest_name":    testManifestName,
+		"bfp_build_number": 1,
+	})
+	requireNoErrors(t, diags)
+
+	if got := fake.requestCount(fake.artifactsPath(1)); got != 3 {
+		t.Errorf("listed artifacts %d times, want 3", got)
+	}
+	if got := fake.requestCount("/downloads/" + build.artifacts[0].id); got != 2 {
+		t.Errorf("downloaded the manifest %d times, want 2", got)
+	}
+}
+
+func TestDataStileManifestReadClientError(t *testing.T) {
+	fake := newFakeBuildkite(t)
+	fake.addArtifact(fake.addBuild(1), testManifestName, testManifest)
+	fake.failNext(fake.artifactsPath(1), http.StatusForbidden)
+	p := testProvider(t, fake)
+
+	_, diags := readDataSource(t, p, "stile_manifest", map[string]interface{}{
+		"manifest_name":     testManifestName,
+		"bfp_build_number":  1,
+		"fallback_manifest": testFallbackManifest,
+	})
+	// Not being allowed to see the build isn't the same as it not having
+	// the manifest, so there's no falling back.
+	requireError(t, diags, "Unable to list buildkite artifacts for build 1 in pipeline test-org/test-pipeline")
+
+	if got := fake.requestCount(fake.artifactsPath(1)); got != 1 {
+		t.Errorf("listed artifacts %d times, want 1", got)
+	}
+}
+
+func TestDataStileManifestReadIntegrity(t *testing.T) {
+	truncated := testManifest[:len(testManifest)/2]
+	// The same size as the real thing, so only the SHA-1 gives it away.
+	tampered := strings.Replace(testManifest, "ami-intel", "ami-evil1", 1)
+
+	tests := []struct {
+		name           string
+		bodies         []string
+		wantDownloads  int
+		wantErrSummary string
+	}{
+		{name: "truncated once", bodies: []string{truncated}, wantDownloads: 2},
+		{name: "tampered once", bodies: []string{tampered}, wantDownloads: 2},
+		{
+			name:           "always truncated",
+			bodies:         []string{truncated, truncated},
+			wantDownloads:  2,
+			wantErrSummary: "Artifact untested-prober-service-manifest.json downloaded from Buildkite failed verification",
+		},
+		{
+			name:           "always tampered",
+			bodies:         []string{tampered, tampered},
+			wantDownloads:  2,
+			wantErrSummary: "Artifact untested-prober-service-manifest.json downloaded from Buildkite failed verification",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := newFakeBuildkite(t)
+			build := fake.addBuild(1)
+			fake.addArtifact(build, testManifestName, testManifest)
+			fake.corruptNext(build, testManifestName, test.bodies...)
+			p := testProviderWithConfig(t, fake, map[string]interface{}{"max_retries": 1})
+
+			d, diags := readDataSource(t, p, "stile_manifest", map[string]interface{}{
+				"manifest_name":     testManifestName,
+				"bfp_build_number":  1,
+				"architecture":      "IntelLinux",
+				"fallback_manifest": testFallbackManifest,
+			})
+			if got := fake.requestCount("/downloads/" + build.artifacts[0].id); got != test.wantDownloads {
+				t.Errorf("downloaded the manifest %d times, want %d", got, test.wantDownloads)
+			}
+			if test.wantErrSummary != "" {
+				// A manifest that fails verification isn't the same as a
+				// missing one, so there's no falling back.
+				requireError(t, diags, test.wantErrSummary)
+				return
+			}
+			requireNoErrors(t, diags)
+
+			if got := d.Get("amis.base-ami"); got != "ami-intel" {
+				t.Errorf("amis[base-ami] = %q, want %q", got, "ami-intel")
+			}
+		})
+	}
+}
+
+func TestDataStileManifestReadExpectedSHA256(t *testing.T) {
+	fake := newFakeBuildkite(t)
+	fake.addArtifact(fake.addBuild(1), testManifestName, testManifest)
+	p := testProvider(t, fake)
+
+	for _, expected := range []string{sha256Hex(testManifest), strings.ToUpper(sha256Hex(testManifest))} {
+		d, diags := readDataSource(t, p, "stile_manifest", map[string]interface{}{
+			"manifest_name":    testManifestName,
+			"bfp_build_number": 1,
+			"expected_sha256":  expected,
+		})
+		requireNoErrors(t, diags)
+		if got := d.Id(); got != sha256Hex(testManifest) {
+			t.Errorf("id = %q, want the SHA-256 of the manifest", got)
+		}
+	}
+
+	_, diags := readDataSource(t, p, "stile_manifest", map[string]interface{}{
+		"manifest_name":    testManifestName,
+		"bfp_build_number": 1,
+		"expected_sha256":  sha256Hex(testFallbackManifest),
+	})
+	requireError(t, diags, "Manifest untested-prober-service-manifest.json for build 1 in test-org/test-pipeline doesn't match expected_sha256")
+}
+
+func TestDataStileManifestReadNotFound(t *testing.T) {
+	fake := newFakeBuildkite(t)
+	fake.addBuild(1)
+	p := testProvider(t, fake)
+
+	_, diags := readDataSource(t, p, "stile_manifest", map[string]interface{}{
+		"manifest_name":    testManifestName,
+		"bfp_build_number": 1,
+	})
+	requireError(t, diags, "Manifest untested-prober-service-manifest.json not found for build 1 in test-org/test-pipeline")
+}
+
+func TestDataStileManifestReadFallback(t *testing.T) {
+	fake := newFakeBuildkite(t)
+	build := fake.addBuild(1)
+	p := testProvider(t, fake)
+
+	d, diags := readDataSource(t, p, "stile_manifest", map[string]interface{}{
+		"manifest_name":     testManifestName,
+		"bfp_build_number":  1,
+		"fallback_manifest": testFallbackManifest,
+	})
+	requireNoErrors(t, diags)
+
+	if !hasWarning(diags, "Manifest untested-prober-service-manifest.json not found for build 1 in test-org/test-pipeline, using the one from the inline manifest") {
+		t.Errorf("expected a warning about using the fallback, got: %v", diags)
+	}
+	if got := d.Get("name"); got != "fallback" {
+		t.Errorf("name = %q, want %q", got, "fallback")
+	}
+	if got := d.Get("used_fallback_manifest"); got != true {
+		t.Errorf("used_fallback_manifest = %v, want true", got)
+	}
+	if got := d.Id(); got != sha256Hex(testFallbackManifest) {
+		t.Errorf("id = %q, want the SHA-256 of the fallback manifest", got)
+	}
+	if got := d.Get("fallback_used_at"); got != "" {
+		t.Errorf("fallback_used_at = %q without a cache_dir, want it empty", got)
+	}
+
+	// Without a cache_dir there's nowhere to remember the fallback, so
+	// the next run looks for the manifest again.
+	fake.addArtifact(build, testManifestName, testManifest)
+	d, diags = planDataSource(t, testProvider(t, fake), "stile_manifest", map[string]interface{}{
+		"manifest_name":     testManifestName,
+		"bfp_build_number":  1,
+		"fallback_manifest": testFallbackManifest,
+	})
+	requireNoErrors(t, diags)
+	if got := d.Get("name"); got != "926993" {
+		t.Errorf("name = %q after the manifest turned up, want %q", got, "926993")
+	}
+}
+
+func TestDataStileManifestReadFallbackPinned(t *testing.T) {
+	fake := newFakeBuildkite(t)
+	build := fake.addBuild(1)
+	cacheDir := tempDir(t)
+	raw := map[string]interface{}{
+		"manifest_name":     testManifestName,
+		"bfp_build_number":  1,
+		"fallback_manifest": testFallbackManifest,
+	}
+
+	d, diags := planDataSource(t, testProviderWithConfig(t, fake, map[string]interface{}{"cache_dir": cacheDir}), "stile_manifest", raw)
+	requireNoErrors(t, diags)
+	if got := d.Get("name"); got != "fallback" {
+		t.Errorf("name = %q, want %q", got, "fallback")
+	}
+	usedAt := d.Get("fallback_used_at").(string)
+	if _, err := time.Parse(time.RFC3339, usedAt); err != nil {
+		t.Errorf("fallback_used_at = %q, want an RFC 3339 time: %v", usedAt, err)
+	}
+
+	// Once the fallback has been used it's kept, even if the manifest
+	// turns up, so that plans are stable. A new provider, like the next
+	// terraform run, so only cache_dir carries over.
+	fake.addArtifact(build, testManifestName, testManifest)
+	listings := fake.requestCount(fake.artifactsPath(1))
+
+	d, diags = planDataSource(t, testProviderWithConfig(t, fake, map[string]interface{}{"cache_dir": cacheDir}), "stile_manifest", raw)
+	requireNoErrors(t, diags)
+
+	if got := d.Get("name"); got != "fallback" {
+		t.Errorf("name = %q after the manifest turned up, want %q", got, "fallback")
+	}
+	if got := d.Get("fallback_used_at"); got != usedAt {
+		t.Errorf("fallback_used_at = %q on the next run, want it kept as %q", got, usedAt)
+	}
+	if !hasWarning(diags, "Manifest untested-prober-service-manifest.json is still pinned to the fallback from the inline manifest, used since "+usedAt) {
+		t.Errorf("expected a warning about the pinned fallback, got: %v", diags)
+	}
+	if got := fake.requestCount(fake.artifactsPath(1)); got != listings {
+		t.Errorf("Buildkite was asked for the build's artifacts again")
+	}
+}
+
+func TestDataStileManifestReadFallbackBuilds(t *testing.T) {
+	fake := newFakeBuildkite(t)
+	buildManifest := func(number int) string {
+		return fmt.Sprintf(`{"name": "%d", "amis": {}, "service_versions": {}}`, number)
+	}
+	// The latest passing build of master doesn't have the manifest, and
+	// the latest one that does failed.
+	fake.addBuild(10)
+	failed := fake.addBuild(9)
+	failed.state = "failed"
+	fake.addArtifact(failed, testManifestName, buildManifest(9))
+	fake.addArtifact(fake.addBuild(8), testManifestName, buildManifest(8))
+	release := fake.addBuild(7)
+	release.branch = "release"
+	fake.addArtifact(release, testManifestName, buildManifest(7))
+	fake.addArtifact(fake.addBuild(6), testManifestName, buildManifest(6))
+	p := testProvider(t, fake)
+
+	tests := []struct {
+		name             string
+		raw              map[string]interface{}
+		wantBuildNumber  int
+		wantWarning      string
+		wantErrSummary   string
+		wantErrDetailHas string
+	}{
+		{
+			name:            "fallback_build_number",
+			raw:             map[string]interface{}{"fallback_build_number": 6},
+			wantBuildNumber: 6,
+			wantWarning:     "Manifest untested-prober-service-manifest.json not found for build 10 in test-org/test-pipeline, using the one from build 6 in test-org/test-pipeline",
+		},
+		{
+			name:            "fallback_to_latest_passing",
+			raw:             map[string]interface{}{"fallback_to_latest_passing": true, "fallback_branch": "master"},
+			wantBuildNumber: 8,
+			wantWarning:     "Manifest untested-prober-service-manifest.json not found for build 10 in test-org/test-pipeline, using the one from build 8 in test-org/test-pipeline (the latest passing build of master)",
+		},
+		{
+			name:            "fallback_to_latest_passing on another branch",
+			raw:             map[string]interface{}{"fallback_to_latest_passing": true, "fallback_branch": "release"},
+			wantBuildNumber: 7,
+		},
+		{
+			name:           "fallback_build_number without the manifest",
+			raw:            map[string]interface{}{"fallback_build_number": 10},
+			wantErrSummary: "Manifest untested-prober-service-manifest.json not found for build 10 in test-org/test-pipeline, or build 10 in test-org/test-pipeline",
+		},
+		{
+			name:           "fallback_to_latest_passing without a build",
+			raw:            map[string]interface{}{"fallback_to_latest_passing": true, "fallback_branch": "missing"},
+			wantErrSummary: "Manifest untested-prober-service-manifest.json not found for build 10 in test-org/test-pipeline, or the latest passing build of missing in test-org/test-pipeline",
+		},
+		{
+			name:             "fallback_to_latest_passing without fallback_branch",
+			raw:              map[string]interface{}{"fallback_to_latest_passing": true},
+			wantErrSummary:   "Invalid manifest source",
+			wantErrDetailHas: "fallback_to_latest_passing needs a fallback_branch",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.raw["manifest_name"] = testManifestName
+			test.raw["bfp_build_number"] = 10
+			d, diags := readDataSource(t, p, "stile_manifest", test.raw)
+			if test.wantErrSummary != "" {
+				requireError(t, diags, test.wantErrSummary)
+				if test.wantErrDetailHas != "" && !strings.Contains(diags[0].Detail, test.wantErrDetailHas) {
+					t.Errorf("detail = %q, want it to contain %q", diags[0].Detail, test.wantErrDetailHas)
+				}
+				return
+			}
+			requireNoErrors(t, diags)
+
+			if got := d.Get("resolved_build_number"); got != test.wantBuildNumber {
+				t.Errorf("resolved_build_number = %v, want %d", got, test.wantBuildNumber)
+			}
+			if got, want := d.Get("name"), fmt.Sprint(test.wantBuildNumber); got != want {
+				t.Errorf("name = %q, want %q", got, want)
+			}
+			if got := d.Get("bfp_build_number"); got != 10 {
+				t.Errorf("bfp_build_number = %v, want 10", got)
+			}
+			if got := d.Get("used_fallback_manifest"); got != true {
+				t.Errorf("used_fallback_manifest = %v, want true", got)
+			}
+			if got := d.Get("resolved_source_index"); got != 1 {
+				t.Errorf("resolved_source_index = %v, want 1", got)
+			}
+			if test.wantWarning != "" && !hasWarning(diags, test.wantWarning) {
+				t.Errorf("expected a warning %q, got: %v", test.wantWarning, diags)
+			}
+		})
+	}
+}
+
+func TestDataStileManifestReadRefreshFallback(t *testing.T) {
+	hourAgo := time.Now().Add(-time.Hour).UTC().Format(time.RFC3339)
+	twoDaysAgo := time.Now().Add(-48 * time.Hour).UTC().Format(time.RFC3339)
+
+	tests := []struct {
+		name    string
+		config  map[string]interface{}
+		usedAt  string
+		turnsUp bool
+		noCache bool
+
+		wantName string
+		// Whether fallback_used_at should be kept as it was, rather than
+		// cleared or reset.
+		wantUsedAtKept bool
+		wantPinned     bool
+		wantError      string
+	}{
+		{
+			name:           "never",
+			config:         map[string]interface{}{},
+			usedAt:         twoDaysAgo,
+			turnsUp:        true,
+			wantName:       "fallback",
+			wantUsedAtKept: true,
+			wantPinned:     true,
+		},
+		{
+			// There's nowhere to have remembered the fallback.
+			name:     "never, without a cache_dir",
+			config:   map[string]interface{}{},
+			usedAt:   twoDaysAgo,
+			turnsUp:  true,
+			noCache:  true,
+			wantName: "926993",
+		},
+		{
+			name:     "always",
+			config:   map[string]interface{}{"refresh_fallback": "always"},
+			usedAt:   hourAgo,
+			turnsUp:  true,
+			wantName: "926993",
+		},
+		{
+			// Still the same fallback, so it's still been used since
+			// the first time.
+			name:           "always, still missing",
+			config:         map[string]interface{}{"refresh_fallback": "always"},
+			usedAt:         hourAgo,
+			wantName:       "fallback",
+			wantUsedAtKept: true,
+		},
+		{
+			name:           "after_duration, inside the window",
+			config:         map[string]interface{}{"refresh_fallback": "after_duration", "refresh_fallback_after": "24h"},
+			usedAt:         hourAgo,
+			turnsUp:        true,
+			wantName:       "fallback",
+			wantUsedAtKept: true,
+			wantPinned:     true,
+		},
+		{
+			name:     "after_duration, expired",
+			config:   map[string]interface{}{"refresh_fallback": "after_duration", "refresh_fallback_after": "24h"},
+			usedAt:   twoDaysAgo,
+			turnsUp:  true,
+			wantName: "926993",
+		},
+		{
+			name:     "after_duration, expired and still missing",
+			config:   map[string]interface{}{"refresh_fallback": "after_duration", "refresh_fallback_after": "24h"},
+			usedAt:   twoDaysAgo,
+			wantName: "fallback",
+		},
+		{
+			name:      "after_duration without refresh_fallback_after",
+			config:    map[string]interface{}{"refresh_fallback": "after_duration"},
+			usedAt:    hourAgo,
+			wantError: `refresh_fallback = "after_duration" needs a refresh_fallback_after`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := newFakeBuildkite(t)
+			build := fake.addBuild(1)
+
+			extra := map[string]interface{}{}
+			if !test.noCache {
+				extra["cache_dir"] = tempDir(t)
+			}
+			raw := map[string]interface{}{
+				"manifest_name":     testManifestName,
+				"bfp_build_number":  1,
+				"fallback_manifest": testFallbackManifest,
+			}
+			for k, v := range test.config {
+				raw[k] = v
+			}
+			// The first run falls back, with refresh_fallback = "always"
+			// so that a missing refresh_fallback_after doesn't stop it.
+			first := map[string]interface{}{"refresh_fallback": "always"}
+			for k, v := range raw {
+				if k != "refresh_fallback" {
+					first[k] = v
+				}
+			}
+			_, diags := planDataSource(t, testProviderWithConfig(t, fake, extra), "stile_manifest", first)
+			requireNoErrors(t, diags)
+			if !test.noCache {
+				setPinnedFallbackUsedAt(t, extra["cache_dir"].(string), test.usedAt)
+			}
+
+			if test.turnsUp {
+				fake.addArtifact(build, testManifestName, testManifest)
+			}
+
+			d, diags := planDataSource(t, testProviderWithConfig(t, fake, extra), "stile_manifest", raw)
+			if test.wantError != "" {
+				requireError(t, diags, test.wantError)
+				return
+			}
+			requireNoErrors(t, diags)
+
+			if got := d.Get("name"); got != test.wantName {
+				t.Errorf("name = %q, want %q", got, test.wantName)
+			}
+
+			usedFallback := test.wantName == "fallback"
+			if got := d.Get("used_fallback_manifest"); got != usedFallback {
+				t.Errorf("used_fallback_manifest = %v, want %v", got, usedFallback)
+			}
+
+			usedAt := d.Get("fallback_used_at").(string)
+			switch {
+			case test.wantUsedAtKept && usedAt != test.usedAt:
+				t.Errorf("fallback_used_at = %q, want it kept as %q", usedAt, test.usedAt)
+			case !test.wantUsedAtKept && usedFallback && usedAt == test.usedAt:
+				t.Errorf("fallback_used_at = %q, want it reset after looking for the manifest again", usedAt)
+			case !usedFallback && usedAt != "":
+				t.Errorf("fallback_used_at = %q, want it cleared", usedAt)
+			}
+
+			pinned := hasWarning(diags, "Manifest untested-prober-service-manifest.json is still pinned to the fallback from the inline manifest, used since "+test.usedAt)
+			if pinned != test.wantPinned {
+				t.Errorf("pinned warning = %v, want %v: %v", pinned, test.wantPinned, diags)
+			}
+		})
+	}
+}
+
+// setPinnedFallbackUsedAt changes when the fallback pinned in cacheDir,
+// for testManifestName from build 1, was first used.
+func setPinnedFallbackUsedAt(t *testing.T, cacheDir string, usedAt string) {
+	t.Helper()
+
+	cache := &diskCache{dir: cacheDir}
+	key := "test-org/test-pipeline/" + testManifestName + "/build_number:1"
+	pin, err := cache.getPin(key)
+	if err != nil || pin == nil {
+		t.Fatalf("no fallback pinned under %s: %v", key, err)
+	}
+	pin.UsedAt, err = time.Parse(time.RFC3339, usedAt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.putPin(key, *pin); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDataStileManifestReadNoFallback(t *testing.T) {
+	fake := newFakeBuildkite(t)
+	fake.addBuild(1)
+	p := testProvider(t, fake)
+
+	config := map[string]interface{}{
+		"manifest_name":     testManifestName,
+		"bfp_build_number":  1,
+		"fallback_manifest": testFallbackManifest,
+	}
+
+	setenv(t, "STILE_MANIFEST_NO_FALLBACK", "true")
+	_, diags := readDataSource(t, p, "stile_manifest", config)
+	requireError(t, diags, "Manifest untested-prober-service-manifest.json not found for build 1 in test-org/test-pipeline")
+
+	setenv(t, "STILE_MANIFEST_NO_FALLBACK", "maybe")
+	_, diags = readDataSource(t, p, "stile_manifest", config)
+	requireError(t, diags, "Invalid valid for environment variable STILE_MANIFEST_NO_FALLBACK")
+
+	setenv(t, "STILE_MANIFEST_NO_FALLBACK", "false")
+	d, diags := readDataSource(t, p, "stile_manifest", config)
+	requireNoErrors(t, diags)
+	if got := d.Get("name"); got != "fallback" {
+		t.Errorf("name = %q, want %q", got, "fallback")
+	}
+}
+
+func TestDataStileManifestReadArchitecture(t *testing.T) {
+	fake := newFakeBuildkite(t)
+	fake.addArtifact(fake.addBuild(1), testManifestName, testManifest)
+	p := testProvider(t, fake)
+
+	tests := []struct {
+		architecture   string
+		region         string
+		wantAMI        string
+		wantProber     string
+		wantErrSummary string
+	}{
+		{architecture: "", wantAMI: "ami-top", wantProber: "prober-top"},
+		{architecture: "", region: "us-west-2", wantAMI: "ami-top-usw2", wantProber: "prober-top"},
+		{architecture: "", region: "ap-southeast-2", wantAMI: "ami-top", wantProber: "prober-top"},
+		{architecture: "IntelLinux", wantAMI: "ami-intel", wantProber: "prober-intel"},
+		{architecture: "GravitonLinux", wantAMI: "ami-graviton", wantProber: "prober-graviton"},
+		{architecture: "WindowsArm", wantErrSummary: `No entry for architecture "WindowsArm" in manifest untested-prober-service-manifest.json for build 1 in test-org/test-pipeline`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.architecture+"/"+test.region, func(t *testing.T) {
+			d, diags := readDataSource(t, p, "stile_manifest", map[string]interface{}{
+				"manifest_name":    testManifestName,
+				"bfp_build_number": 1,
+				"architecture":     test.architecture,
+				"region":           test.region,
+			})
+			if test.wantErrSummary != "" {
+				requireError(t, diags, test.wantErrSummary)
+				return
+			}
+			requireNoErrors(t, diags)
+
+			if got := d.Get("amis.base-ami"); got != test.wantAMI {
+				t.Errorf("amis[base-ami] = %q, want %q", got, test.wantAMI)
+			}
+			if got := d.Get("service_versions.stile-prober"); got != test.wantProber {
+				t.Errorf("service_versions[stile-prober] = %q, want %q", got, test.wantProber)
+			}
+
+			want := []interface{}{"GravitonLinux", "IntelLinux"}
+			if got := d.Get("available_architectures"); !reflect.DeepEqual(got, want) {
+				t.Errorf("available_architectures = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestDataStileManifestReadInvalid(t *testing.T) {
+	fake := newFakeBuildkite(t)
+	fake.addArtifact(fake.addBuild(1), testManifestName, `{"name": "1", "IntelLinux": "pending", "GravitonLinux": {"amis": {"base-ami": 7}, "service_versions": {}}}`)
+	p := testProvider(t, fake)
+
+	_, diags := readDataSource(t, p, "stile_manifest", map[string]interface{}{
+		"manifest_name":    testManifestName,
+		"bfp_build_number": 1,
+		"architecture":     "IntelLinux",
+	})
+
+	// Every problem is reported, not just the first.
+	requireError(t, diags, "Manifest untested-prober-service-manifest.json for build 1 in test-org/test-pipeline is invalid: $.GravitonLinux.amis.base-ami: expected string, got number")
+	requireError(t, diags, "Manifest untested-prober-service-manifest.json for build 1 in test-org/test-pipeline is invalid: $.IntelLinux: expected object, got string")
+}
+
+func TestDataStileManifestReadRequiredKeys(t *testing.T) {
+	fake := newFakeBuildkite(t)
+	fake.addArtifact(fake.addBuild(1), testManifestName, testManifest)
+	p := testProvider(t, fake)
+
+	_, diags := readDataSource(t, p, "stile_manifest", map[string]interface{}{
+		"manifest_name":             testManifestName,
+		"bfp_build_number":          1,
+		"architecture":              "IntelLinux",
+		"required_service_versions": []interface{}{"stile-prober", "stile-consul"},
+		"required_amis":             []interface{}{"base-ami", "bastion-ami"},
+	})
+	requireError(t, diags, "Manifest untested-prober-service-manifest.json for build 1 in test-org/test-pipeline is missing required keys")
+
+	want := `These keys were required but aren't in architecture "IntelLinux": service_versions["stile-consul"], amis["bastion-ami"].`
+	if got := diags[len(diags)-1].Detail; got != want {
+		t.Errorf("detail = %q, want %q", got, want)
+	}
+}
+
+func TestDataStileManifestID(t *testing.T) {
+	fake := newFakeBuildkite(t)
+	other := `{"name": "other", "amis": {}, "service_versions": {}}`
+	fake.addArtifact(fake.addBuild(1), testManifestName, testManifest)
+	fake.addArtifact(fake.addBuild(2), testManifestName, other)
+	fake.addArtifact(fake.addBuild(3), testManifestName, testManifest)
+	p := testProvider(t, fake)
+
+	ids := map[int]string{}
+	for _, buildNumber := range []int{1, 2, 3} {
+		d, diags := readDataSource(t, p, "stile_manifest", map[string]interface{}{
+			"manifest_name":    testManifestName,
+			"bfp_build_number": buildNumber,
+		})
+		requireNoErrors(t, diags)
+		ids[buildNumber] = d.Id()
+	}
+
+	// The id is the SHA-256 of the manifest itself, so it only changes
+	// when the manifest does.
+	if ids[1] != sha256Hex(testManifest) {
+		t.Errorf("id = %q, want the SHA-256 of the manifest %q", ids[1], sha256Hex(testManifest))
+	}
+	if ids[2] != sha256Hex(other) {
+		t.Errorf("id = %q, want the SHA-256 of the manifest %q", ids[2], sha256Hex(other))
+	}
+	if ids[1] != ids[3] {
+		t.Errorf("identical manifests have different ids: %q and %q", ids[1], ids[3])
+	}
+	if ids[1] == sha256Hex("") {
+		t.Errorf("id is the SHA-256 of nothing")
+	}
+}
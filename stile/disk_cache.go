@@ -0,0 +1,232 @@
+package stile
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/buildkite/go-buildkite/v2/buildkite"
+)
+
+// diskCache keeps Buildkite artifacts on disk, so that the manifests of
+// builds we've already seen are still available when Buildkite (or the
+// VPN) isn't. A build's artifacts never change once it's finished, so
+// there's no expiry, but nor are listings of builds that haven't finished
+// kept.
+//
+// Artifact listings are stored by org/pipeline/build, and the artifacts
+// themselves by their SHA-1, which is checked whenever they're read:
+//
+//	<dir>/listings/<org>/<pipeline>/<build>.json
+//	<dir>/artifacts/<sha1[:2]>/<sha1>
+//
+// It also keeps the fallbacks stile_manifest has pinned, see fallbackPin:
+//
+//	<dir>/pins/<sha256 of the pin's key>.json
+type diskCache struct {
+	dir string
+}
+
+// notCachedError means something isn't in the cache.
+type notCachedError struct {
+	what string
+}
+
+func (e *notCachedError) Error() string {
+	return fmt.Sprintf("%s isn't cached", e.what)
+}
+
+func (c *diskCache) listingPath(org string, pipeline string, buildNumber string) string {
+	return filepath.Join(c.dir, "listings", url.PathEscape(org), url.PathEscape(pipeline), url.PathEscape(buildNumber)+".json")
+}
+
+func (c *diskCache) artifactPath(sha1sum string) string {
+	sha1sum = strings.ToLower(sha1sum)
+	return filepath.Join(c.dir, "artifacts", sha1sum[:2], sha1sum)
+}
+
+// getListing returns the cached artifact listing of a build.
+func (c *diskCache) getListing(org string, pipeline string, buildNumber string) ([]buildkite.Artifact, error) {
+	path := c.listingPath(org, pipeline, buildNumber)
+
+	body, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, &notCachedError{what: fmt.Sprintf("The artifact listing of build %s in %s/%s (%s)", buildNumber, org, pipeline, path)}
+		}
+		return nil, err
+	}
+
+	var artifacts []buildkite.Artifact
+	if err := json.Unmarshal(body, &artifacts); err != nil {
+		return nil, fmt.Errorf("corrupt cache entry %s: %v", path, err)
+	}
+
+	return artifacts, nil
+}
+
+func (c *diskCache) putListing(org string, pipeline string, buildNumber string, artifacts []buildkite.Artifact) error {
+	body, err := json.Marshal(artifacts)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(c.listingPath(org, pipeline, buildNumber), body)
+}
+
+// getArtifact returns the cached contents of an artifact with the given
+// SHA-1. A corrupt entry is removed and treated as missing.
+func (c *diskCache) getArtifact(artifact buildkite.Artifact) ([]byte, error) {
+	sha1sum := stringValue(artifact.SHA1)
+	if !isSHA1(sha1sum) {
+		return nil, &notCachedError{what: fmt.Sprintf("Artifact %s, which has no SHA-1 to cache it by,", stringValue(artifact.Filename))}
+	}
+
+	path := c.artifactPath(sha1sum)
+	missing := &notCachedError{what: fmt.Sprintf("Artifact %s with SHA-1 %s (%s)", stringValue(artifact.Filename), sha1sum, path)}
+
+	body, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, missing
+		}
+		return nil, err
+	}
+
+	if err := verifyArtifact(artifact, body); err != nil {
+		os.Remove(path)
+		return nil, missing
+	}
+
+	return body, nil
+}
+
+func (c *diskCache) putArtifact(artifact buildkite.Artifact, body []byte) error {
+	// Only cache what we can check when it's read back.
+	sha1sum := stringValue(artifact.SHA1)
+	if !isSHA1(sha1sum) || !strings.EqualFold(fmt.Sprintf("%x", sha1.Sum(body)), sha1sum) {
+		return nil
+	}
+
+	return writeFileAtomic(c.artifactPath(sha1sum), body)
+}
+
+// fallbackPin is the fallback a stile_manifest read used, so that the
+// next read can stick with it (see refresh_fallback). Terraform doesn't
+// give data sources the state from their last read, so this is the only
+// way a read knows what the previous one did.
+type fallbackPin struct {
+	// The manifestChainEntry's key.
+	Source string `json:"source"`
+	// The build the manifest came from, if it came from one.
+	BuildNumber int       `json:"build_number,omitempty"`
+	UsedAt      time.Time `json:"used_at"`
+}
+
+func (c *diskCache) pinPath(key string) string {
+	return filepath.Join(c.dir, "pins", fmt.Sprintf("%x.json", sha256.Sum256([]byte(key))))
+}
+
+// getPin returns the fallback pinned under key, or nil if there isn't
+// one.
+func (c *diskCache) getPin(key string) (*fallbackPin, error) {
+	path := c.pinPath(key)
+
+	body, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var pin fallbackPin
+	if err := json.Unmarshal(body, &pin); err != nil {
+		return nil, fmt.Errorf("corrupt cache entry %s: %v", path, err)
+	}
+
+	return &pin, nil
+}
+
+func (c *diskCache) putPin(key string, pin fallbackPin) error {
+	body, err := json.Marshal(pin)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(c.pinPath(key), body)
+}
+
+func (c *diskCache) deletePin(key string) error {
+	if err := os.Remove(c.pinPath(key)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// offlineError explains that err, if it's a *notCachedError, is because
+// the provider is offline.
+func offlineError(c *stileClient, err error) error {
+	var notCached *notCachedError
+	if !errors.As(err, &notCached) {
+		return err
+	}
+
+	return diagnosticError{
+		summary: fmt.Sprintf("%s, and the provider is offline", notCached),
+		detail:  fmt.Sprintf("offline (or STILE_OFFLINE) is set, so only what's already cached in %s can be used. Run Terraform with Buildkite reachable to cache it.", c.cache.dir),
+		err:     err,
+	}
+}
+
+// isUnreachableError reports whether err means the server couldn't be
+// reached at all, rather than it responding with an error.
+func isUnreachableError(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+func isSHA1(s string) bool {
+	if len(s) != 2*sha1.Size {
+		return false
+	}
+	for _, r := range strings.ToLower(s) {
+		if (r < '0' || r > '9') && (r < 'a' || r > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// writeFileAtomic writes a file by renaming a temporary one into place,
+// so that concurrent Terraform runs sharing a cache never see part of one.
+func writeFileAtomic(path string, body []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(path), ".tmp-"+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(body); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), path)
+}
@@ -0,0 +1,191 @@
+package stile
+
+import (
+	"context"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/buildkite/go-buildkite/v2/buildkite"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/terraform"
+)
+
+func tempDir(t *testing.T) string {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "stile-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+func TestDiskCacheArtifacts(t *testing.T) {
+	cache := &diskCache{dir: tempDir(t)}
+
+	body := []byte(testManifest)
+	filename := testManifestName
+	sha1sum := fmt.Sprintf("%x", sha1.Sum(body))
+	artifact := buildkite.Artifact{Filename: &filename, SHA1: &sha1sum}
+
+	var notCached *notCachedError
+	if _, err := cache.getArtifact(artifact); !errors.As(err, &notCached) {
+		t.Fatalf("expected a *notCachedError before caching, got %v", err)
+	}
+
+	if err := cache.putArtifact(artifact, body); err != nil {
+		t.Fatal(err)
+	}
+	got, err := cache.getArtifact(artifact)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != testManifest {
+		t.Errorf("got %q back from the cache, want the manifest", got)
+	}
+
+	// A corrupt entry is as good as missing, and is removed.
+	if err := ioutil.WriteFile(cache.artifactPath(sha1sum), []byte("{}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cache.getArtifact(artifact); !errors.As(err, &notCached) {
+		t.Fatalf("expected a *notCachedError for a corrupt entry, got %v", err)
+	}
+	if _, err := os.Stat(cache.artifactPath(sha1sum)); !os.IsNotExist(err) {
+		t.Errorf("corrupt entry wasn't removed: %v", err)
+	}
+
+	// Nothing's cached that couldn't be checked when it's read back.
+	wrong := strings.Repeat("0", 40)
+	if err := cache.putArtifact(buildkite.Artifact{Filename: &filename, SHA1: &wrong}, body); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(cache.artifactPath(wrong)); !os.IsNotExist(err) {
+		t.Errorf("artifact was cached under the wrong SHA-1")
+	}
+}
+
+func TestDataStileManifestReadOffline(t *testing.T) {
+	fake := newFakeBuildkite(t)
+	fake.addArtifact(fake.addBuild(1), testManifestName, testManifest)
+	fake.addArtifact(fake.addBuild(2), testManifestName, testManifest)
+	cacheDir := tempDir(t)
+
+	// Reading online fills the cache.
+	p := testProviderWithConfig(t, fake, map[string]interface{}{"cache_dir": cacheDir})
+	_, diags := readDataSource(t, p, "stile_manifest", map[string]interface{}{
+		"manifest_name":    testManifestName,
+		"bfp_build_number": 1,
+	})
+	requireNoErrors(t, diags)
+
+	// Offline, Buildkite isn't touched at all.
+	fake.failNext(fake.artifactsPath(1), http.StatusInternalServerError)
+	p = testProviderWithConfig(t, fake, map[string]interface{}{"cache_dir": cacheDir, "offline": true})
+	d, diags := readDataSource(t, p, "stile_manifest", map[string]interface{}{
+		"manifest_name":    testManifestName,
+		"bfp_build_number": 1,
+	})
+	requireNoErrors(t, diags)
+	if got := d.Id(); got != sha256Hex(testManifest) {
+		t.Errorf("id = %q, want the SHA-256 of the manifest", got)
+	}
+	if got := fake.requestCount(fake.artifactsPath(1)); got != 1 {
+		t.Errorf("listed artifacts %d times, want 1", got)
+	}
+
+	// Builds that haven't been seen say what's missing.
+	_, diags = readDataSource(t, p, "stile_manifest", map[string]interface{}{
+		"manifest_name":    testManifestName,
+		"bfp_build_number": 2,
+	})
+	if !diags.HasError() || !strings.HasPrefix(diags[0].Summary, "The artifact listing of build 2 in test-org/test-pipeline (") || !strings.HasSuffix(diags[0].Summary, ") isn't cached, and the provider is offline") {
+		t.Errorf("expected an error saying build 2's listing isn't cached, got: %v", diags)
+	}
+}
+
+func TestDataStileManifestReadOfflineRunning(t *testing.T) {
+	fake := newFakeBuildkite(t)
+	build := fake.addBuild(1)
+	build.state = "running"
+	fake.addArtifact(build, testManifestName, testManifest)
+	cacheDir := tempDir(t)
+
+	p := testProviderWithConfig(t, fake, map[string]interface{}{"cache_dir": cacheDir})
+	_, diags := readDataSource(t, p, "stile_manifest", map[string]interface{}{
+		"manifest_name":    testManifestName,
+		"bfp_build_number": 1,
+	})
+	requireNoErrors(t, diags)
+
+	// The build could still upload more, so its listing wasn't kept.
+	p = testProviderWithConfig(t, fake, map[string]interface{}{"cache_dir": cacheDir, "offline": true})
+	_, diags = readDataSource(t, p, "stile_manifest", map[string]interface{}{
+		"manifest_name":    testManifestName,
+		"bfp_build_number": 1,
+	})
+	if !diags.HasError() || !strings.HasPrefix(diags[0].Summary, "The artifact listing of build 1 in test-org/test-pipeline (") {
+		t.Errorf("expected an error saying build 1's listing isn't cached, got: %v", diags)
+	}
+
+	// Once it's finished, it is.
+	build.state = "passed"
+	p = testProviderWithConfig(t, fake, map[string]interface{}{"cache_dir": cacheDir})
+	_, diags = readDataSource(t, p, "stile_manifest", map[string]interface{}{
+		"manifest_name":    testManifestName,
+		"bfp_build_number": 1,
+	})
+	requireNoErrors(t, diags)
+
+	p = testProviderWithConfig(t, fake, map[string]interface{}{"cache_dir": cacheDir, "offline": true})
+	_, diags = readDataSource(t, p, "stile_manifest", map[string]interface{}{
+		"manifest_name":    testManifestName,
+		"bfp_build_number": 1,
+	})
+	requireNoErrors(t, diags)
+}
+
+func TestDataStileManifestReadUnreachable(t *testing.T) {
+	fake := newFakeBuildkite(t)
+	fake.addArtifact(fake.addBuild(1), testManifestName, testManifest)
+	cacheDir := tempDir(t)
+
+	p := testProviderWithConfig(t, fake, map[string]interface{}{"cache_dir": cacheDir})
+	_, diags := readDataSource(t, p, "stile_manifest", map[string]interface{}{
+		"manifest_name":    testManifestName,
+		"bfp_build_number": 1,
+	})
+	requireNoErrors(t, diags)
+
+	// Without the VPN, what's been cached is still used.
+	fake.server.Close()
+	p = testProviderWithConfig(t, fake, map[string]interface{}{"cache_dir": cacheDir, "max_retries": 0})
+	d, diags := readDataSource(t, p, "stile_manifest", map[string]interface{}{
+		"manifest_name":    testManifestName,
+		"bfp_build_number": 1,
+	})
+	requireNoErrors(t, diags)
+	if got := d.Get("name"); got != "926993" {
+		t.Errorf("name = %q, want %q", got, "926993")
+	}
+}
+
+func TestProviderConfigureOffline(t *testing.T) {
+	fake := newFakeBuildkite(t)
+
+	setenv(t, "STILE_OFFLINE", "true")
+	p := Provider("test")
+	diags := p.Configure(context.Background(), terraform.NewResourceConfigRaw(map[string]interface{}{}))
+	requireError(t, diags, "The provider is offline but there's no cache_dir")
+
+	p = testProviderWithConfig(t, fake, map[string]interface{}{"cache_dir": tempDir(t)})
+	if !p.Meta().(*stileClient).offline {
+		t.Errorf("STILE_OFFLINE didn't turn on offline mode")
+	}
+}
@@ -0,0 +1,409 @@
+package stile
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeBuildkite is an in-process stand-in for the parts of the Buildkite
+// REST API that the provider uses: listing a pipeline's builds, getting
+// one, listing a build's artifacts and downloading them. Listings are
+// paginated with Link headers, like the real thing, and failures can be
+// injected per path.
+type fakeBuildkite struct {
+	t      *testing.T
+	server *httptest.Server
+
+	org      string
+	pipeline string
+	token    string
+	// How many items each page of a listing has.
+	perPage int
+
+	mu       sync.Mutex
+	builds   map[int]*fakeBuild
+	failures map[string][]int
+	holds    map[string]*fakeHold
+	requests []string
+}
+
+// fakeHold keeps a request waiting, see holdNext.
+type fakeHold struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+type fakeBuild struct {
+	number    int
+	branch    string
+	commit    string
+	state     string
+	artifacts []fakeArtifact
+}
+
+type fakeArtifact struct {
+	id       string
+	jobID    string
+	filename string
+	path     string
+	// "finished" if it's empty.
+	state string
+	body  []byte
+	// Served instead of body, one per download, before body is, see
+	// corruptNext.
+	corruptBodies [][]byte
+}
+
+func newFakeBuildkite(t *testing.T) *fakeBuildkite {
+	f := &fakeBuildkite{
+		t:        t,
+		org:      "test-org",
+		pipeline: "test-pipeline",
+		token:    "test-token",
+		perPage:  30,
+		builds:   map[int]*fakeBuild{},
+		failures: map[string][]int{},
+		holds:    map[string]*fakeHold{},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", f.serveAPI)
+	mux.HandleFunc("/downloads/", f.serveDownload)
+
+	f.server = httptest.NewServer(mux)
+	t.Cleanup(f.server.Close)
+
+	return f
+}
+
+func (f *fakeBuildkite) URL() string {
+	return f.server.URL
+}
+
+// addBuild adds a passed build of master, which tests can change.
+func (f *fakeBuildkite) addBuild(number int) *fakeBuild {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	build := &fakeBuild{
+		number: number,
+		branch: "master",
+		commit: fmt.Sprintf("%040d", number),
+		state:  "passed",
+	}
+	f.builds[number] = build
+	return build
+}
+
+// addArtifact adds an artifact to build, with a unique ID.
+func (f *fakeBuildkite) addArtifact(build *fakeBuild, filename string, body string) {
+	f.addArtifactAt(build, "artifacts/"+filename, fmt.Sprintf("job-%d", build.number), body)
+}
+
+// addArtifactAt adds an artifact uploaded to artifactPath by the given job.
+func (f *fakeBuildkite) addArtifactAt(build *fakeBuild, artifactPath string, jobID string, body string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	build.artifacts = append(build.artifacts, fakeArtifact{
+		id:       fmt.Sprintf("artifact-%d-%d", build.number, len(build.artifacts)),
+		jobID:    jobID,
+		filename: path.Base(artifactPath),
+		path:     artifactPath,
+		body:     []byte(body),
+	})
+}
+
+// corruptNext makes the next downloads of build's artifact with the given
+// filename serve bodies, one per download, while the listing still
+// describes the real body. Later downloads get the real one.
+func (f *fakeBuildkite) corruptNext(build *fakeBuild, filename string, bodies ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for i := range build.artifacts {
+		if build.artifacts[i].filename == filename {
+			for _, body := range bodies {
+				build.artifacts[i].corruptBodies = append(build.artifacts[i].corruptBodies, []byte(body))
+			}
+			return
+		}
+	}
+	f.t.Fatalf("build %d has no artifact %s", build.number, filename)
+}
+
+// failNext makes the next requests for path fail with the given statuses,
+// one per request, before it starts succeeding again.
+func (f *fakeBuildkite) failNext(path string, statuses ...int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.failures[path] = append(f.failures[path], statuses...)
+}
+
+// holdNext makes the next request for path wait until release is called.
+// started is closed once that request has arrived.
+func (f *fakeBuildkite) holdNext(path string) (started <-chan struct{}, release func()) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	hold := &fakeHold{started: make(chan struct{}), release: make(chan struct{})}
+	f.holds[path] = hold
+
+	var once sync.Once
+	release = func() { once.Do(func() { close(hold.release) }) }
+	// The server can't shut down while a request is held.
+	f.t.Cleanup(release)
+
+	return hold.started, release
+}
+
+// requestCount returns how many requests there have been for path.
+func (f *fakeBuildkite) requestCount(path string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	count := 0
+	for _, request := range f.requests {
+		if request == path {
+			count++
+		}
+	}
+	return count
+}
+
+func (f *fakeBuildkite) pipelinePath() string {
+	return fmt.Sprintf("/v2/organizations/%s/pipelines/%s/builds", f.org, f.pipeline)
+}
+
+func (f *fakeBuildkite) artifactsPath(buildNumber int) string {
+	return fmt.Sprintf("%s/%d/artifacts", f.pipelinePath(), buildNumber)
+}
+
+// record notes the request and returns the status it should fail with, or
+// 0 if it shouldn't.
+func (f *fakeBuildkite) record(r *http.Request) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.requests = append(f.requests, r.URL.Path)
+
+	if hold, ok := f.holds[r.URL.Path]; ok {
+		delete(f.holds, r.URL.Path)
+		close(hold.started)
+		f.mu.Unlock()
+		<-hold.release
+		f.mu.Lock()
+	}
+
+	if statuses := f.failures[r.URL.Path]; len(statuses) != 0 {
+		f.failures[r.URL.Path] = statuses[1:]
+		return statuses[0]
+	}
+	return 0
+}
+
+func (f *fakeBuildkite) serveAPI(w http.ResponseWriter, r *http.Request) {
+	if status := f.record(r); status != 0 {
+		http.Error(w, `{"message":"injected failure"}`, status)
+		return
+	}
+
+	if r.Header.Get("Authorization") != "Bearer "+f.token {
+		http.Error(w, `{"message":"Authentication required"}`, http.StatusUnauthorized)
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch path := r.URL.Path; {
+	case path == f.pipelinePath():
+		f.serveBuilds(w, r)
+
+	case strings.HasPrefix(path, f.pipelinePath()+"/") && strings.HasSuffix(path, "/artifacts"):
+		number, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(path, f.pipelinePath()+"/"), "/artifacts"))
+		build, ok := f.builds[number]
+		if err != nil || !ok {
+			http.Error(w, `{"message":"No build found"}`, http.StatusNotFound)
+			return
+		}
+		f.serveArtifacts(w, r, build)
+
+	case strings.HasPrefix(path, f.pipelinePath()+"/"):
+		number, err := strconv.Atoi(strings.TrimPrefix(path, f.pipelinePath()+"/"))
+		build, ok := f.builds[number]
+		if err != nil || !ok {
+			http.Error(w, `{"message":"No build found"}`, http.StatusNotFound)
+			return
+		}
+		f.serveBuild(w, r, build)
+
+	default:
+		http.Error(w, `{"message":"Not found"}`, http.StatusNotFound)
+	}
+}
+
+func (f *fakeBuildkite) serveBuilds(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	// Newest first, like Buildkite.
+	numbers := make([]int, 0, len(f.builds))
+	for number := range f.builds {
+		numbers = append(numbers, number)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(numbers)))
+
+	var builds []interface{}
+	for _, number := range numbers {
+		build := f.builds[number]
+		if branch := query.Get("branch"); branch != "" && branch != build.branch {
+			continue
+		}
+		if commit := query.Get("commit"); commit != "" && commit != build.commit {
+			continue
+		}
+		if states := query["state[]"]; len(states) != 0 && !containsString(states, build.state) {
+			continue
+		}
+		builds = append(builds, f.buildJSON(build))
+	}
+
+	f.servePage(w, r, builds)
+}
+
+func (f *fakeBuildkite) serveBuild(w http.ResponseWriter, r *http.Request, build *fakeBuild) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(f.buildJSON(build)); err != nil {
+		f.t.Errorf("encoding response: %v", err)
+	}
+}
+
+// buildJSON is how Buildkite describes build.
+func (f *fakeBuildkite) buildJSON(build *fakeBuild) map[string]interface{} {
+	result := map[string]interface{}{
+		"number":     build.number,
+		"branch":     build.branch,
+		"commit":     build.commit,
+		"state":      build.state,
+		"web_url":    fmt.Sprintf("https://buildkite.com/%s/%s/builds/%d", f.org, f.pipeline, build.number),
+		"created_at": fmt.Sprintf("2020-01-01T00:00:%02d.000Z", build.number%60),
+	}
+	// Builds that are still going haven't finished.
+	switch build.state {
+	case "scheduled", "running", "blocked", "canceling", "failing":
+	default:
+		result["finished_at"] = fmt.Sprintf("2020-01-01T00:01:%02d.000Z", build.number%60)
+	}
+	return result
+}
+
+func (f *fakeBuildkite) serveArtifacts(w http.ResponseWriter, r *http.Request, build *fakeBuild) {
+	var artifacts []interface{}
+	for _, artifact := range build.artifacts {
+		state := artifact.state
+		if state == "" {
+			state = "finished"
+		}
+		artifacts = append(artifacts, map[string]interface{}{
+			"id":           artifact.id,
+			"job_id":       artifact.jobID,
+			"filename":     artifact.filename,
+			"path":         artifact.path,
+			"state":        state,
+			"mime_type":    "application/json",
+			"file_size":    len(artifact.body),
+			"sha1sum":      fmt.Sprintf("%x", sha1.Sum(artifact.body)),
+			"download_url": fmt.Sprintf("%s/downloads/%s", f.server.URL, artifact.id),
+		})
+	}
+
+	f.servePage(w, r, artifacts)
+}
+
+// servePage writes the requested page of items, with a Link header
+// pointing at the next one if there is one.
+func (f *fakeBuildkite) servePage(w http.ResponseWriter, r *http.Request, items []interface{}) {
+	page := 1
+	if p := r.URL.Query().Get("page"); p != "" {
+		page, _ = strconv.Atoi(p)
+	}
+
+	start := (page - 1) * f.perPage
+	if start > len(items) {
+		start = len(items)
+	}
+	end := start + f.perPage
+	if end > len(items) {
+		end = len(items)
+	}
+
+	if end < len(items) {
+		next := *r.URL
+		query := next.Query()
+		query.Set("page", strconv.Itoa(page+1))
+		next.RawQuery = query.Encode()
+		w.Header().Set("Link", fmt.Sprintf(`<%s%s>; rel="next"`, f.server.URL, next.String()))
+	}
+
+	// An empty page is [], not null.
+	result := append([]interface{}{}, items[start:end]...)
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		f.t.Errorf("encoding response: %v", err)
+	}
+}
+
+func (f *fakeBuildkite) serveDownload(w http.ResponseWriter, r *http.Request) {
+	if status := f.record(r); status != 0 {
+		http.Error(w, "injected failure", status)
+		return
+	}
+
+	id, err := url.PathUnescape(strings.TrimPrefix(r.URL.Path, "/downloads/"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, build := range f.builds {
+		for i := range build.artifacts {
+			artifact := &build.artifacts[i]
+			if artifact.id != id {
+				continue
+			}
+			if len(artifact.corruptBodies) != 0 {
+				w.Write(artifact.corruptBodies[0])
+				artifact.corruptBodies = artifact.corruptBodies[1:]
+				return
+			}
+			w.Write(artifact.body)
+			return
+		}
+	}
+
+	http.NotFound(w, r)
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
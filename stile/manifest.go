@@ -0,0 +1,329 @@
+package stile
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// manifest is a decoded manifest JSON document, as produced by the
+// `create_untested_manifest` Rake task in the BFP, eg:
+//
+//	{
+//	  "name": "926993",
+//	  "commits": {"git@github.com:StileEducation/...": "<sha>"},
+//	  "amis": {"base-ami": "ami-...", "base-ami:us-west-2": "ami-..."},
+//	  "service_versions": {"stile-prober": "..."},
+//	  "IntelLinux": {"amis": {...}, "service_versions": {...}},
+//	  "GravitonLinux": {"amis": {...}, "service_versions": {...}}
+//	}
+//
+// The top-level "amis" and "service_versions" don't commit to a specific
+// architecture.
+type manifest struct {
+	Name            string
+	Commits         map[string]string
+	AMIs            map[string]string
+	ServiceVersions map[string]string
+	// Keyed by architecture name, eg: "IntelLinux".
+	Architectures map[string]manifestArchitecture
+
+	// The document as it was decoded, including any fields that aren't
+	// modelled above.
+	raw map[string]interface{}
+}
+
+type manifestArchitecture struct {
+	AMIs            map[string]string
+	ServiceVersions map[string]string
+}
+
+// These top-level manifest keys aren't architectures.
+var nonArchitectureManifestKeys = map[string]bool{
+	"name":             true,
+	"schema_version":   true,
+	"amis":             true,
+	"service_versions": true,
+	"commits":          true,
+}
+
+// The manifest schema versions this provider understands. Manifests say
+// which version they follow with a top-level "schema_version", which is
+// assumed to be 1 if it's missing. Bump this, and teach decodeManifest the
+// differences, when the `create_untested_manifest` Rake task changes the
+// manifest's shape.
+const (
+	minManifestSchemaVersion = 1
+	maxManifestSchemaVersion = 1
+)
+
+// manifestProblem is one way a manifest doesn't match the schema, at a
+// JSONPath-ish location, eg: `$.GravitonLinux.amis.base-ami`.
+type manifestProblem struct {
+	path    string
+	message string
+}
+
+func (p manifestProblem) String() string {
+	return fmt.Sprintf("%s: %s", p.path, p.message)
+}
+
+// manifestValidationError lists every problem found with a manifest, so
+// they can all be fixed at once.
+type manifestValidationError struct {
+	problems []manifestProblem
+}
+
+func (e *manifestValidationError) Error() string {
+	problems := make([]string, 0, len(e.problems))
+	for _, problem := range e.problems {
+		problems = append(problems, problem.String())
+	}
+	return fmt.Sprintf("invalid manifest: %s", strings.Join(problems, "; "))
+}
+
+// decodeManifest decodes and validates a manifest. The "amis" and
+// "service_versions" of the given architecture, or the top-level ones if
+// it's empty, are required; they're what the caller is about to use. An
+// architecture that's missing altogether isn't reported here, so the
+// caller can explain that separately.
+//
+// Validation problems are returned as a *manifestValidationError.
+func decodeManifest(r io.Reader, architecture string) (*manifest, error) {
+	// Numbers are kept as they were written, so that manifest_json
+	// doesn't round large integers through a float64.
+	decoder := json.NewDecoder(r)
+	decoder.UseNumber()
+
+	var document interface{}
+	if err := decoder.Decode(&document); err != nil {
+		return nil, &manifestValidationError{
+			problems: []manifestProblem{{path: "$", message: fmt.Sprintf("not valid JSON: %v", err)}},
+		}
+	}
+
+	v := &manifestValidator{}
+
+	raw, ok := v.object("$", document)
+	if !ok {
+		return nil, &manifestValidationError{problems: v.problems}
+	}
+
+	if version, ok := raw["schema_version"]; ok {
+		number, isNumber := version.(json.Number)
+		n, err := number.Int64()
+		if !isNumber || err != nil {
+			v.problemf("$.schema_version", "expected an integer, got %s", jsonType(version))
+		} else if n < minManifestSchemaVersion || n > maxManifestSchemaVersion {
+			// Nothing else is worth checking if we don't know what the
+			// manifest should look like.
+			v.problemf("$.schema_version", "version %d isn't supported by this version of the provider, which supports versions %d to %d", n, minManifestSchemaVersion, maxManifestSchemaVersion)
+			return nil, &manifestValidationError{problems: v.problems}
+		}
+	}
+
+	m := &manifest{
+		Architectures: map[string]manifestArchitecture{},
+		raw:           raw,
+	}
+
+	if name, ok := raw["name"]; !ok {
+		v.problemf("$.name", "missing")
+	} else {
+		m.Name = v.string("$.name", name)
+	}
+
+	m.Commits = v.stringMap("$", raw, "commits", false)
+	m.AMIs = v.stringMap("$", raw, "amis", architecture == "")
+	m.ServiceVersions = v.stringMap("$", raw, "service_versions", architecture == "")
+
+	// Keys are visited in order so problems are always reported in the
+	// same order.
+	for _, key := range sortedKeys(raw) {
+		if nonArchitectureManifestKeys[key] {
+			continue
+		}
+
+		value := raw[key]
+
+		path := jsonPath("$", key)
+
+		items, ok := value.(map[string]interface{})
+		if !ok {
+			// The selected architecture has to be a map, other
+			// unmodelled fields can be anything.
+			if key == architecture {
+				v.problemf(path, "expected object, got %s", jsonType(value))
+			}
+			continue
+		}
+
+		m.Architectures[key] = manifestArchitecture{
+			AMIs:            v.stringMap(path, items, "amis", key == architecture),
+			ServiceVersions: v.stringMap(path, items, "service_versions", key == architecture),
+		}
+	}
+
+	if len(v.problems) != 0 {
+		return nil, &manifestValidationError{problems: v.problems}
+	}
+
+	return m, nil
+}
+
+// manifestValidator collects problems as a manifest is decoded.
+type manifestValidator struct {
+	problems []manifestProblem
+}
+
+func (v *manifestValidator) problemf(path string, format string, args ...interface{}) {
+	v.problems = append(v.problems, manifestProblem{path: path, message: fmt.Sprintf(format, args...)})
+}
+
+func (v *manifestValidator) object(path string, value interface{}) (map[string]interface{}, bool) {
+	items, ok := value.(map[string]interface{})
+	if !ok {
+		v.problemf(path, "expected object, got %s", jsonType(value))
+	}
+	return items, ok
+}
+
+func (v *manifestValidator) string(path string, value interface{}) string {
+	s, ok := value.(string)
+	if !ok {
+		v.problemf(path, "expected string, got %s", jsonType(value))
+	}
+	return s
+}
+
+// stringMap returns the map of strings at key in obj, found at path. It's
+// nil if there's nothing at key, which is a problem if it's required.
+func (v *manifestValidator) stringMap(path string, obj map[string]interface{}, key string, required bool) map[string]string {
+	path = jsonPath(path, key)
+
+	value, ok := obj[key]
+	if !ok {
+		if required {
+			v.problemf(path, "missing")
+		}
+		return nil
+	}
+
+	items, ok := v.object(path, value)
+	if !ok {
+		return nil
+	}
+
+	result := make(map[string]string, len(items))
+	for _, k := range sortedKeys(items) {
+		result[k] = v.string(jsonPath(path, k), items[k])
+	}
+	return result
+}
+
+func sortedKeys(obj map[string]interface{}) []string {
+	keys := make([]string, 0, len(obj))
+	for key := range obj {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// jsonPath appends key to path, quoting it if it wouldn't be readable
+// otherwise.
+func jsonPath(path string, key string) string {
+	if key == "" || strings.ContainsAny(key, ".[]\" \t") {
+		return fmt.Sprintf("%s[%q]", path, key)
+	}
+	return path + "." + key
+}
+
+// jsonType names the JSON type of a value decoded by encoding/json.
+func jsonType(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case json.Number, float64:
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	default:
+		return fmt.Sprintf("%T", value)
+	}
+}
+
+// canonicalJSON re-encodes the whole manifest with sorted keys and no
+// whitespace. Numbers and strings come out as they went in, without
+// HTML escaping.
+func (m *manifest) canonicalJSON() (string, error) {
+	var b bytes.Buffer
+	encoder := json.NewEncoder(&b)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(m.raw); err != nil {
+		return "", err
+	}
+
+	return strings.TrimSuffix(b.String(), "\n"), nil
+}
+
+// architectureNames returns the sorted names of the manifest's
+// architectures.
+func (m *manifest) architectureNames() []string {
+	names := make([]string, 0, len(m.Architectures))
+	for name := range m.Architectures {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// splitAMIKey splits a manifest AMI key like "base-ami:us-west-2" into its
+// name and region. The region is empty for unqualified keys.
+func splitAMIKey(key string) (string, string) {
+	if i := strings.LastIndex(key, ":"); i != -1 {
+		return key[:i], key[i+1:]
+	}
+	return key, ""
+}
+
+// resolveRegionalAMIs returns the AMIs to use in region, keyed by their
+// unqualified names. Region-specific AMIs take precedence over unqualified
+// ones, and AMIs for other regions are left out.
+func resolveRegionalAMIs(amis map[string]string, region string) map[string]string {
+	resolved := map[string]string{}
+	for key, ami := range amis {
+		name, amiRegion := splitAMIKey(key)
+		if amiRegion == "" {
+			if _, ok := resolved[name]; !ok {
+				resolved[name] = ami
+			}
+		} else if amiRegion == region {
+			resolved[name] = ami
+		}
+	}
+	return resolved
+}
+
+// amiRegions returns the sorted regions that AMI keys are qualified with.
+func amiRegions(amis map[string]string) []string {
+	seen := map[string]bool{}
+	var regions []string
+	for key := range amis {
+		if _, region := splitAMIKey(key); region != "" && !seen[region] {
+			seen[region] = true
+			regions = append(regions, region)
+		}
+	}
+	sort.Strings(regions)
+	return regions
+}
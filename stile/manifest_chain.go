@@ -0,0 +1,275 @@
+package stile
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// manifestChainEntry is one place stile_manifest can get a manifest from,
+// as given by a "source" block. Entries are tried in order until one of
+// them has the manifest. Exactly one field is set.
+type manifestChainEntry struct {
+	// A specific build, or the latest Buildkite build of a commit that
+	// has the manifest.
+	buildNumber int
+	commit      string
+	// The latest passing build of a branch that has the manifest.
+	latestPassingBranch string
+	// A file on the machine running Terraform.
+	file string
+	// Fetched with a GET, which has to succeed.
+	url string
+	// The manifest itself.
+	json string
+}
+
+// The values of resolved_source. A build's manifest comes from wherever
+// manifest_source says, which needn't be Buildkite.
+const (
+	manifestSourceBuild              = "build"
+	manifestSourceLatestPassingBuild = "latest_passing_build"
+	manifestSourceFile               = "file"
+	manifestSourceURL                = "url"
+	manifestSourceJSON               = "json"
+)
+
+func (e manifestChainEntry) kind() string {
+	switch {
+	case e.buildNumber != 0 || e.commit != "":
+		return manifestSourceBuild
+	case e.latestPassingBranch != "":
+		return manifestSourceLatestPassingBuild
+	case e.file != "":
+		return manifestSourceFile
+	case e.url != "":
+		return manifestSourceURL
+	default:
+		return manifestSourceJSON
+	}
+}
+
+// key identifies e by what it points at rather than where it is in the
+// chain, so that a pinned fallback is found again, or not at all, after
+// the source blocks have been reordered.
+func (e manifestChainEntry) key() string {
+	switch {
+	case e.buildNumber != 0:
+		return fmt.Sprintf("build_number:%d", e.buildNumber)
+	case e.commit != "":
+		return "commit:" + e.commit
+	case e.latestPassingBranch != "":
+		return "latest_passing_branch:" + e.latestPassingBranch
+	case e.file != "":
+		return "file:" + e.file
+	case e.url != "":
+		return "url:" + e.url
+	default:
+		return fmt.Sprintf("json:%x", sha256.Sum256([]byte(e.json)))
+	}
+}
+
+// manifestChainEntryFromMap reads a "source" block.
+func manifestChainEntryFromMap(block map[string]interface{}) (manifestChainEntry, error) {
+	e := manifestChainEntry{
+		buildNumber:         block["build_number"].(int),
+		commit:              block["commit"].(string),
+		latestPassingBranch: block["latest_passing_branch"].(string),
+		file:                block["file"].(string),
+		url:                 block["url"].(string),
+		json:                block["json"].(string),
+	}
+
+	set := 0
+	for _, isSet := range []bool{e.buildNumber != 0, e.commit != "", e.latestPassingBranch != "", e.file != "", e.url != "", e.json != ""} {
+		if isSet {
+			set++
+		}
+	}
+	if set != 1 {
+		return e, fmt.Errorf("exactly one of build_number, commit, latest_passing_branch, file, url or json must be set, got %d", set)
+	}
+
+	if e.url != "" {
+		u, err := url.Parse(e.url)
+		if err != nil || u.Scheme != "https" || u.Host == "" {
+			return e, fmt.Errorf("url must be an https:// URL, got %q", e.url)
+		}
+	}
+
+	return e, nil
+}
+
+// fetchedManifest is a manifest found by a manifestChainEntry.
+type fetchedManifest struct {
+	body io.Reader
+	// The build it came from, and where that build's manifests are, if it
+	// came from a build at all.
+	buildNumber string
+	source      ManifestSource
+	// Where it came from, for diagnostics, eg: "build 5 in org/pipeline".
+	description string
+}
+
+// fetch gets the manifest from wherever e points, returning nil if it
+// isn't there. Builds' manifests come from source. If pinnedBuildNumber
+// isn't 0 it's used instead of searching for the latest passing build, so
+// we can stick with a build we've used before.
+//
+// The returned description is set even if the manifest isn't found.
+func (e manifestChainEntry) fetch(ctx context.Context, c *stileClient, source ManifestSource, manifestName string, pinnedBuildNumber int) (*fetchedManifest, string, error) {
+	switch e.kind() {
+	case manifestSourceBuild, manifestSourceLatestPassingBuild:
+		return e.fetchFromBuild(ctx, c, source, manifestName, pinnedBuildNumber)
+
+	case manifestSourceFile:
+		description := fmt.Sprintf("file %s", e.file)
+		body, err := ioutil.ReadFile(e.file)
+		if os.IsNotExist(err) {
+			return nil, description, nil
+		}
+		if err != nil {
+			return nil, description, diagnosticError{
+				summary: fmt.Sprintf("Unable to read manifest %s from %s", manifestName, e.file),
+				detail:  err.Error(),
+				err:     err,
+			}
+		}
+		return &fetchedManifest{body: bytes.NewReader(body), description: description}, description, nil
+
+	case manifestSourceURL:
+		description := fmt.Sprintf("URL %s", e.url)
+		body, err := fetchManifestURL(ctx, c, e.url)
+		if err != nil {
+			return nil, description, diagnosticError{
+				summary: fmt.Sprintf("Unable to fetch manifest %s from %s", manifestName, e.url),
+				detail:  err.Error(),
+				err:     err,
+			}
+		}
+		if body == nil {
+			return nil, description, nil
+		}
+		return &fetchedManifest{body: bytes.NewReader(body), description: description}, description, nil
+
+	default:
+		description := "the inline manifest"
+		return &fetchedManifest{body: strings.NewReader(e.json), description: description}, description, nil
+	}
+}
+
+func (e manifestChainEntry) fetchFromBuild(ctx context.Context, c *stileClient, source ManifestSource, manifestName string, pinnedBuildNumber int) (*fetchedManifest, string, error) {
+	var buildNumber string
+	var description string
+	switch {
+	case e.buildNumber != 0:
+		buildNumber = strconv.Itoa(e.buildNumber)
+		description = source.Describe(buildNumber)
+	case e.commit != "":
+		description = fmt.Sprintf("commit %s in %s/%s", e.commit, c.org, c.pipeline)
+	case pinnedBuildNumber != 0:
+		buildNumber = strconv.Itoa(pinnedBuildNumber)
+		description = fmt.Sprintf("%s (the latest passing build of %s)", source.Describe(buildNumber), e.latestPassingBranch)
+	default:
+		description = fmt.Sprintf("the latest passing build of %s in %s/%s", e.latestPassingBranch, c.org, c.pipeline)
+	}
+
+	// Builds are always searched for in Buildkite, wherever their
+	// manifests are. Each request to Buildkite is retried according to
+	// the provider's retryPolicy, so there's no need to retry here.
+	if buildNumber == "" {
+		if err := requireBuildkite(c); err != nil {
+			return nil, description, err
+		}
+
+		filter := buildFilter{commit: e.commit, artifactName: manifestName}
+		if e.latestPassingBranch != "" {
+			filter = buildFilter{branch: e.latestPassingBranch, states: []string{"passed"}, artifactName: manifestName}
+		}
+
+		build, err := findBuildkiteBuild(ctx, c, filter)
+		if err != nil || build == nil {
+			return nil, description, err
+		}
+
+		buildNumber = strconv.Itoa(*build.Number)
+		if e.commit != "" {
+			description = fmt.Sprintf("%s (commit %s)", source.Describe(buildNumber), e.commit)
+		} else {
+			description = fmt.Sprintf("%s (the latest passing build of %s)", source.Describe(buildNumber), e.latestPassingBranch)
+		}
+	}
+
+	body, err := source.FetchManifest(ctx, buildNumber, manifestName)
+	if err != nil || body == nil {
+		// The build number is still worth knowing if it's the build
+		// stile_manifest was asked about.
+		return &fetchedManifest{buildNumber: buildNumber, description: description}, description, err
+	}
+
+	return &fetchedManifest{body: body, buildNumber: buildNumber, source: source, description: description}, description, nil
+}
+
+// fetchManifestURL GETs a manifest, returning nil if it's not found.
+func fetchManifestURL(ctx context.Context, c *stileClient, manifestURL string) ([]byte, error) {
+	if c.offline {
+		return nil, errors.New("the provider is offline, and only Buildkite artifacts are cached")
+	}
+
+	var body []byte
+	err := c.retry.do(ctx, func() error {
+		req, err := http.NewRequest("GET", manifestURL, nil)
+		if err != nil {
+			return err
+		}
+
+		resp, err := c.http.Do(req.WithContext(ctx))
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode == http.StatusNotFound {
+			body = nil
+			return nil
+		}
+		if resp.StatusCode != http.StatusOK {
+			return &manifestURLError{statusCode: resp.StatusCode}
+		}
+
+		body, err = ioutil.ReadAll(resp.Body)
+		return err
+	})
+	return body, err
+}
+
+// manifestURLError is an unexpected response to a manifest URL.
+type manifestURLError struct {
+	statusCode int
+	// What the response said, if there's more to it than its status.
+	err error
+}
+
+func (e *manifestURLError) Error() string {
+	msg := fmt.Sprintf("unexpected response: %d %s", e.statusCode, http.StatusText(e.statusCode))
+	if e.err != nil {
+		msg += ": " + e.err.Error()
+	}
+	return msg
+}
+
+func (e *manifestURLError) Unwrap() error {
+	return e.err
+}
@@ -0,0 +1,303 @@
+package stile
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+)
+
+// testSourcesManifest is a manifest named name, for telling sources apart.
+func testSourcesManifest(name string) string {
+	return fmt.Sprintf(`{"name": %q, "amis": {}, "service_versions": {}}`, name)
+}
+
+// fakeManifestServer serves manifests over TLS, with some paths that
+// always fail with a given status.
+type fakeManifestServer struct {
+	server *httptest.Server
+
+	mu       sync.Mutex
+	requests map[string]int
+}
+
+func newFakeManifestServer(t *testing.T) *fakeManifestServer {
+	t.Helper()
+
+	f := &fakeManifestServer{requests: map[string]int{}}
+	f.server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		f.requests[r.URL.Path]++
+		f.mu.Unlock()
+
+		switch r.URL.Path {
+		case "/manifest.json":
+			w.Write([]byte(testSourcesManifest("url")))
+		case "/broken.json":
+			http.Error(w, "broken", http.StatusInternalServerError)
+		case "/forbidden.json":
+			http.Error(w, "forbidden", http.StatusForbidden)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(f.server.Close)
+
+	return f
+}
+
+func (f *fakeManifestServer) requestCount(path string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.requests[path]
+}
+
+// testSourcesProvider is testProviderWithConfig whose HTTP client trusts
+// server.
+func testSourcesProvider(t *testing.T, fake *fakeBuildkite, server *fakeManifestServer, extra map[string]interface{}) *schema.Provider {
+	t.Helper()
+
+	p := testProviderWithConfig(t, fake, extra)
+	p.Meta().(*stileClient).http = server.server.Client()
+	return p
+}
+
+func TestDataStileManifestReadSources(t *testing.T) {
+	fake := newFakeBuildkite(t)
+	release := fake.addBuild(3)
+	release.branch = "release"
+	fake.addArtifact(release, testManifestName, testSourcesManifest("release"))
+	fake.addBuild(4)
+	fake.addArtifact(fake.addBuild(5), testManifestName, testManifest)
+	server := newFakeManifestServer(t)
+	p := testSourcesProvider(t, fake, server, nil)
+
+	dir := tempDir(t)
+	file := filepath.Join(dir, "manifest.json")
+	if err := ioutil.WriteFile(file, []byte(testSourcesManifest("file")), 0644); err != nil {
+		t.Fatal(err)
+	}
+	missingFile := filepath.Join(dir, "missing.json")
+
+	json := testSourcesManifest("json")
+
+	tests := []struct {
+		name    string
+		sources []interface{}
+
+		wantName        string
+		wantSource      string
+		wantIndex       int
+		wantBuildNumber int
+		wantErrSummary  string
+		wantErrDetail   string
+	}{
+		{
+			name:            "first source",
+			sources:         []interface{}{map[string]interface{}{"build_number": 5}, map[string]interface{}{"json": json}},
+			wantName:        "926993",
+			wantSource:      manifestSourceBuild,
+			wantBuildNumber: 5,
+		},
+		{
+			name:            "commit",
+			sources:         []interface{}{map[string]interface{}{"commit": fmt.Sprintf("%040d", 5)}},
+			wantName:        "926993",
+			wantSource:      manifestSourceBuild,
+			wantBuildNumber: 5,
+		},
+		{
+			name:            "latest_passing_branch",
+			sources:         []interface{}{map[string]interface{}{"build_number": 4}, map[string]interface{}{"latest_passing_branch": "release"}},
+			wantName:        "release",
+			wantSource:      manifestSourceLatestPassingBuild,
+			wantIndex:       1,
+			wantBuildNumber: 3,
+		},
+		{
+			name: "file",
+			sources: []interface{}{
+				map[string]interface{}{"build_number": 4},
+				map[string]interface{}{"file": missingFile},
+				map[string]interface{}{"file": file},
+			},
+			wantName:   "file",
+			wantSource: manifestSourceFile,
+			wantIndex:  2,
+		},
+		{
+			name: "url",
+			sources: []interface{}{
+				map[string]interface{}{"build_number": 4},
+				map[string]interface{}{"url": server.server.URL + "/missing.json"},
+				map[string]interface{}{"url": server.server.URL + "/manifest.json"},
+			},
+			wantName:   "url",
+			wantSource: manifestSourceURL,
+			wantIndex:  2,
+		},
+		{
+			name:       "json",
+			sources:    []interface{}{map[string]interface{}{"build_number": 4}, map[string]interface{}{"json": json}},
+			wantName:   "json",
+			wantSource: manifestSourceJSON,
+			wantIndex:  1,
+		},
+		{
+			// In order, so the json isn't reached.
+			name:            "order",
+			sources:         []interface{}{map[string]interface{}{"build_number": 4}, map[string]interface{}{"build_number": 5}, map[string]interface{}{"json": json}},
+			wantName:        "926993",
+			wantSource:      manifestSourceBuild,
+			wantIndex:       1,
+			wantBuildNumber: 5,
+		},
+		{
+			name:           "nowhere",
+			sources:        []interface{}{map[string]interface{}{"build_number": 4}, map[string]interface{}{"file": missingFile}},
+			wantErrSummary: fmt.Sprintf("Manifest %s not found for build 4 in test-org/test-pipeline, or file %s", testManifestName, missingFile),
+		},
+		{
+			// A URL that fails isn't the same as one that doesn't have
+			// the manifest, so there's no falling back.
+			name:           "url error",
+			sources:        []interface{}{map[string]interface{}{"url": server.server.URL + "/broken.json"}, map[string]interface{}{"json": json}},
+			wantErrSummary: fmt.Sprintf("Unable to fetch manifest %s from %s/broken.json", testManifestName, server.server.URL),
+		},
+		{
+			name:           "url forbidden",
+			sources:        []interface{}{map[string]interface{}{"url": server.server.URL + "/forbidden.json"}, map[string]interface{}{"json": json}},
+			wantErrSummary: fmt.Sprintf("Unable to fetch manifest %s from %s/forbidden.json", testManifestName, server.server.URL),
+		},
+		{
+			name:           "more than one field",
+			sources:        []interface{}{map[string]interface{}{"build_number": 4, "json": json}},
+			wantErrSummary: "Invalid manifest source",
+			wantErrDetail:  "source 0: exactly one of build_number, commit, latest_passing_branch, file, url or json must be set, got 2",
+		},
+		{
+			name:           "no fields",
+			sources:        []interface{}{map[string]interface{}{"build_number": 4}, map[string]interface{}{"file": ""}},
+			wantErrSummary: "Invalid manifest source",
+			wantErrDetail:  "source 1: is empty",
+		},
+		{
+			name:           "http url",
+			sources:        []interface{}{map[string]interface{}{"build_number": 4}, map[string]interface{}{"url": "http://example.com/manifest.json"}},
+			wantErrSummary: "Invalid manifest source",
+			wantErrDetail:  `source 1: url must be an https:// URL, got "http://example.com/manifest.json"`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			d, diags := readDataSource(t, p, "stile_manifest", map[string]interface{}{
+				"manifest_name": testManifestName,
+				"source":        test.sources,
+			})
+			if test.wantErrSummary != "" {
+				requireError(t, diags, test.wantErrSummary)
+				if test.wantErrDetail != "" && diags[0].Detail != test.wantErrDetail {
+					t.Errorf("detail = %q, want %q", diags[0].Detail, test.wantErrDetail)
+				}
+				return
+			}
+			requireNoErrors(t, diags)
+
+			if got := d.Get("name"); got != test.wantName {
+				t.Errorf("name = %q, want %q", got, test.wantName)
+			}
+			if got := d.Get("resolved_source"); got != test.wantSource {
+				t.Errorf("resolved_source = %q, want %q", got, test.wantSource)
+			}
+			if got := d.Get("resolved_source_index"); got != test.wantIndex {
+				t.Errorf("resolved_source_index = %v, want %d", got, test.wantIndex)
+			}
+			if got := d.Get("resolved_build_number"); got != test.wantBuildNumber {
+				t.Errorf("resolved_build_number = %v, want %d", got, test.wantBuildNumber)
+			}
+			if got := d.Get("used_fallback_manifest"); got != (test.wantIndex > 0) {
+				t.Errorf("used_fallback_manifest = %v, want %v", got, test.wantIndex > 0)
+			}
+		})
+	}
+
+	// Server errors are retried, anything else in the 4xx range isn't.
+	if got, want := server.requestCount("/broken.json"), defaultMaxRetries+1; got != want {
+		t.Errorf("fetched the broken URL %d times, want %d", got, want)
+	}
+	if got := server.requestCount("/forbidden.json"); got != 1 {
+		t.Errorf("fetched the forbidden URL %d times, want 1", got)
+	}
+}
+
+func TestDataStileManifestReadSourcesReordered(t *testing.T) {
+	fake := newFakeBuildkite(t)
+	release := fake.addBuild(3)
+	release.branch = "release"
+	fake.addArtifact(release, testManifestName, testSourcesManifest("release"))
+	fake.addBuild(4)
+	server := newFakeManifestServer(t)
+	cacheDir := tempDir(t)
+
+	build := map[string]interface{}{"build_number": 4}
+	latestPassing := map[string]interface{}{"latest_passing_branch": "release"}
+	inline := map[string]interface{}{"json": testSourcesManifest("json")}
+	plan := func(sources ...interface{}) (*schema.ResourceData, string) {
+		t.Helper()
+
+		// A new provider each time, like separate terraform runs.
+		p := testSourcesProvider(t, fake, server, map[string]interface{}{"cache_dir": cacheDir})
+		d, diags := planDataSource(t, p, "stile_manifest", map[string]interface{}{
+			"manifest_name": testManifestName,
+			"source":        sources,
+		})
+		requireNoErrors(t, diags)
+
+		var warnings []string
+		for _, diag := range diags {
+			warnings = append(warnings, diag.Summary)
+		}
+		return d, strings.Join(warnings, "\n")
+	}
+
+	d, _ := plan(build, latestPassing, inline)
+	if got := d.Get("resolved_build_number"); got != 3 {
+		t.Fatalf("resolved_build_number = %v, want 3", got)
+	}
+
+	// A newer passing build of the branch doesn't replace the pinned
+	// one, and the pin follows its source to its new place.
+	newer := fake.addBuild(6)
+	newer.branch = "release"
+	fake.addArtifact(newer, testManifestName, testSourcesManifest("newer"))
+
+	d, warnings := plan(build, inline, latestPassing)
+	if got := d.Get("name"); got != "release" {
+		t.Errorf("name = %q after reordering, want %q", got, "release")
+	}
+	if got := d.Get("resolved_source_index"); got != 2 {
+		t.Errorf("resolved_source_index = %v after reordering, want 2", got)
+	}
+	if !strings.Contains(warnings, "is still pinned to the fallback from build 3") {
+		t.Errorf("expected a warning about the pinned fallback, got: %s", warnings)
+	}
+
+	// Without the pinned source there's nothing to stick with, so it
+	// starts again from the first source rather than using whatever's
+	// at the pinned index now.
+	d, warnings = plan(build, inline)
+	if got := d.Get("name"); got != "json" {
+		t.Errorf("name = %q without the pinned source, want %q", got, "json")
+	}
+	if strings.Contains(warnings, "still pinned") {
+		t.Errorf("unexpected warning about a pinned fallback: %s", warnings)
+	}
+}
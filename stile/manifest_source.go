@@ -0,0 +1,120 @@
+package stile
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ManifestSource is somewhere the manifests produced by each build can be
+// fetched from. Buildkite is the usual one, but a local directory lets
+// people and CI jobs without Buildkite credentials plan against checked-in
+// or locally generated manifests.
+type ManifestSource interface {
+	// FetchManifest returns the named manifest (or any other file, eg: its
+	// signature) produced by a build, or nil if the build doesn't have it.
+	FetchManifest(ctx context.Context, buildNumber string, manifestName string) (io.Reader, error)
+
+	// Describe says where a build's manifests are, for diagnostics, eg:
+	// "build 5 in stile-education/big-friendly-pipeline".
+	Describe(buildNumber string) string
+}
+
+// Values of manifest_source, which selects a ManifestSource. There's also
+// manifestSourceSpecS3Prefix.
+const (
+	manifestSourceSpecBuildkite       = "buildkite"
+	manifestSourceSpecDirectoryPrefix = "file://"
+)
+
+// parseManifestSource returns the ManifestSource that a manifest_source
+// value refers to, either "buildkite", "file://<dir>" or
+// "s3://<bucket>/<prefix>". The directory may be relative, eg:
+// "file://manifests" is the "manifests" directory.
+func parseManifestSource(c *stileClient, spec string) (ManifestSource, error) {
+	switch {
+	case spec == "" || spec == manifestSourceSpecBuildkite:
+		return &buildkiteManifestSource{c: c}, nil
+	case strings.HasPrefix(spec, manifestSourceSpecDirectoryPrefix):
+		dir := strings.TrimPrefix(spec, manifestSourceSpecDirectoryPrefix)
+		if dir == "" {
+			return nil, fmt.Errorf("%q doesn't name a directory, eg: \"file://manifests\"", spec)
+		}
+		return &directoryManifestSource{dir: dir}, nil
+	case strings.HasPrefix(spec, manifestSourceSpecS3Prefix):
+		return parseS3ManifestSource(c, spec)
+	default:
+		return nil, fmt.Errorf("%q must be %q, %q followed by a directory or %q followed by a bucket", spec, manifestSourceSpecBuildkite, manifestSourceSpecDirectoryPrefix, manifestSourceSpecS3Prefix)
+	}
+}
+
+// validateManifestSource is the ValidateFunc for manifest_source.
+func validateManifestSource(v interface{}, k string) ([]string, []error) {
+	if _, err := parseManifestSource(nil, v.(string)); err != nil {
+		return nil, []error{fmt.Errorf("%q: %v", k, err)}
+	}
+	return nil, nil
+}
+
+// buildkiteManifestSource fetches manifests from the artifacts of builds in
+// the provider's pipeline.
+type buildkiteManifestSource struct {
+	c *stileClient
+}
+
+func (s *buildkiteManifestSource) FetchManifest(ctx context.Context, buildNumber string, manifestName string) (io.Reader, error) {
+	if err := requireBuildkite(s.c); err != nil {
+		return nil, err
+	}
+
+	return getBuildkiteArtifact(ctx, s.c, manifestName, buildNumber)
+}
+
+func (s *buildkiteManifestSource) Describe(buildNumber string) string {
+	return fmt.Sprintf("build %s in %s/%s", buildNumber, s.c.org, s.c.pipeline)
+}
+
+// requireBuildkite returns an error if there's no way to talk to
+// Buildkite.
+func requireBuildkite(c *stileClient) error {
+	if c.buildkite == nil && !c.offline {
+		return diagnosticError{
+			summary: "Unable to find a Buildkite API token.",
+			detail:  "Set api_token in the provider block or the BUILDKITE_READ_API_TOKEN environment variable.",
+		}
+	}
+	return nil
+}
+
+// directoryManifestSource reads manifests from a directory laid out like
+// `<dir>/<build_number>/<manifest_name>`.
+type directoryManifestSource struct {
+	dir string
+}
+
+func (s *directoryManifestSource) FetchManifest(ctx context.Context, buildNumber string, manifestName string) (io.Reader, error) {
+	path := filepath.Join(s.dir, buildNumber, manifestName)
+
+	body, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, diagnosticError{
+			summary: fmt.Sprintf("Unable to read %s", path),
+			detail:  err.Error(),
+			err:     err,
+		}
+	}
+
+	return bytes.NewReader(body), nil
+}
+
+func (s *directoryManifestSource) Describe(buildNumber string) string {
+	return fmt.Sprintf("build %s in %s", buildNumber, s.dir)
+}
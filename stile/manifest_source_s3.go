@@ -0,0 +1,202 @@
+package stile
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+)
+
+const manifestSourceSpecS3Prefix = "s3://"
+
+// s3Config is how to reach S3, or something that talks like it (eg:
+// MinIO), from the provider's s3_* arguments. Anything that isn't set is
+// left to the AWS SDK's default chain: environment variables, shared
+// config and credentials files (including profiles that use SSO), web
+// identity tokens and instance or task roles.
+type s3Config struct {
+	// Overrides AWS's regional endpoint. Requests to it use path-style
+	// addressing (https://endpoint/bucket/key), which is what MinIO and
+	// most other stand-ins expect.
+	endpoint string
+	region   string
+	profile  string
+
+	// Static credentials, which take the place of the default chain's.
+	accessKeyID     string
+	secretAccessKey string
+	sessionToken    string
+
+	// The client is only built when an s3:// manifest source is first
+	// read, so that configurations that don't use S3 never load AWS's
+	// config.
+	once   sync.Once
+	client *s3.Client
+	err    error
+}
+
+// s3Client returns the S3 client, building it the first time. Its HTTP
+// client is the SDK's own, so that AWS_CA_BUNDLE works, with the same
+// timeout as manifest URLs. Retries are left to the provider's
+// retryPolicy.
+func (c *s3Config) s3Client(ctx context.Context) (*s3.Client, error) {
+	c.once.Do(func() {
+		options := []func(*config.LoadOptions) error{
+			config.WithHTTPClient(awshttp.NewBuildableClient().WithTimeout(2 * time.Minute)),
+			config.WithRetryer(func() aws.Retryer { return aws.NopRetryer{} }),
+		}
+		if c.region != "" {
+			options = append(options, config.WithRegion(c.region))
+		}
+		if c.profile != "" {
+			options = append(options, config.WithSharedConfigProfile(c.profile))
+		}
+		if c.accessKeyID != "" {
+			options = append(options, config.WithCredentialsProvider(
+				credentials.NewStaticCredentialsProvider(c.accessKeyID, c.secretAccessKey, c.sessionToken),
+			))
+		}
+
+		awsConfig, err := config.LoadDefaultConfig(ctx, options...)
+		if err != nil {
+			c.err = fmt.Errorf("loading AWS config: %w", err)
+			return
+		}
+		if awsConfig.Region == "" {
+			awsConfig.Region = "us-east-1"
+		}
+
+		c.client = s3.NewFromConfig(awsConfig, func(o *s3.Options) {
+			if c.endpoint != "" {
+				o.UsePathStyle = true
+				o.BaseEndpoint = aws.String(c.endpoint)
+			}
+		})
+	})
+
+	return c.client, c.err
+}
+
+// s3ManifestSource reads manifests from objects named like
+// `<prefix>/<build_number>/<manifest_name>` in an S3 bucket.
+type s3ManifestSource struct {
+	c      *stileClient
+	bucket string
+	prefix string
+}
+
+// parseS3ManifestSource parses a manifest_source like "s3://bucket/prefix".
+// The prefix is optional.
+func parseS3ManifestSource(c *stileClient, spec string) (*s3ManifestSource, error) {
+	location := strings.TrimPrefix(spec, manifestSourceSpecS3Prefix)
+	bucket := location
+	prefix := ""
+	if i := strings.Index(location, "/"); i >= 0 {
+		bucket = location[:i]
+		prefix = strings.Trim(location[i+1:], "/")
+	}
+	if bucket == "" {
+		return nil, fmt.Errorf("%q doesn't name a bucket, eg: \"s3://bucket/prefix\"", spec)
+	}
+
+	return &s3ManifestSource{c: c, bucket: bucket, prefix: prefix}, nil
+}
+
+func (s *s3ManifestSource) key(buildNumber string, manifestName string) string {
+	return path.Join(s.prefix, buildNumber, manifestName)
+}
+
+func (s *s3ManifestSource) FetchManifest(ctx context.Context, buildNumber string, manifestName string) (io.Reader, error) {
+	location := fmt.Sprintf("%s%s/%s", manifestSourceSpecS3Prefix, s.bucket, s.key(buildNumber, manifestName))
+	if s.c.offline {
+		return nil, diagnosticError{
+			summary: fmt.Sprintf("Unable to fetch %s, the provider is offline", location),
+			detail:  "Only Buildkite artifacts are cached. Use a manifest_source of \"buildkite\" when offline.",
+		}
+	}
+
+	client, err := s.c.s3.s3Client(ctx)
+	if err != nil {
+		return nil, diagnosticError{
+			summary: fmt.Sprintf("Unable to fetch %s", location),
+			detail:  err.Error(),
+			err:     err,
+		}
+	}
+
+	var body []byte
+	err = s.c.retry.do(ctx, func() error {
+		out, err := client.GetObject(ctx, &s3.GetObjectInput{
+			Bucket: aws.String(s.bucket),
+			Key:    aws.String(s.key(buildNumber, manifestName)),
+		})
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if isS3NotFound(err) {
+				body = nil
+				return nil
+			}
+			return s3Error(err)
+		}
+		defer out.Body.Close()
+
+		body, err = ioutil.ReadAll(out.Body)
+		return err
+	})
+	if err != nil {
+		return nil, diagnosticError{
+			summary: fmt.Sprintf("Unable to fetch %s", location),
+			detail:  err.Error(),
+			err:     err,
+		}
+	}
+	if body == nil {
+		return nil, nil
+	}
+
+	return bytes.NewReader(body), nil
+}
+
+func (s *s3ManifestSource) Describe(buildNumber string) string {
+	return fmt.Sprintf("build %s in %s%s", buildNumber, manifestSourceSpecS3Prefix, path.Join(s.bucket, s.prefix))
+}
+
+// isS3NotFound is whether GetObject failed because there's no such object.
+// Other 404s, eg: NoSuchBucket, mean the manifest_source is wrong rather
+// than the build not having a manifest.
+func isS3NotFound(err error) bool {
+	var noSuchKey *types.NoSuchKey
+	if errors.As(err, &noSuchKey) {
+		return true
+	}
+	var apiErr smithy.APIError
+	return errors.As(err, &apiErr) && apiErr.ErrorCode() == "NoSuchKey"
+}
+
+// s3Error turns an error response from GetObject into one that
+// retryPolicy classifies the same as a manifest URL's, keeping what S3
+// said (eg: AccessDenied or ExpiredToken). Anything else, eg: a network
+// error, is left as it is.
+func s3Error(err error) error {
+	var respErr *awshttp.ResponseError
+	if errors.As(err, &respErr) {
+		return &manifestURLError{statusCode: respErr.HTTPStatusCode(), err: err}
+	}
+	return err
+}
@@ -0,0 +1,305 @@
+package stile
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/terraform"
+)
+
+// fakeS3 is enough of S3 (or MinIO) to serve manifests, with path-style
+// addressing.
+type fakeS3 struct {
+	server      *httptest.Server
+	accessKeyID string
+
+	mu       sync.Mutex
+	buckets  map[string]bool
+	objects  map[string]string
+	failures map[string][]int
+}
+
+func newFakeS3(t *testing.T) *fakeS3 {
+	t.Helper()
+
+	f := &fakeS3{
+		accessKeyID: "test-access-key",
+		buckets:     map[string]bool{},
+		objects:     map[string]string{},
+		failures:    map[string][]int{},
+	}
+	f.server = httptest.NewServer(http.HandlerFunc(f.serveHTTP))
+	t.Cleanup(f.server.Close)
+
+	return f
+}
+
+// putObject adds an object, given its path (ie: /<bucket>/<key>).
+func (f *fakeS3) putObject(path string, body string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.buckets[strings.SplitN(path, "/", 3)[1]] = true
+	f.objects[path] = body
+}
+
+// failNext makes the next requests for path fail with the given statuses.
+func (f *fakeS3) failNext(path string, statuses ...int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.failures[path] = append(f.failures[path], statuses...)
+}
+
+func (f *fakeS3) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential="+f.accessKeyID+"/") || r.Header.Get("X-Amz-Date") == "" {
+		s3ErrorResponse(w, http.StatusForbidden, "AccessDenied", "Access Denied")
+		return
+	}
+
+	if failures := f.failures[r.URL.Path]; len(failures) > 0 {
+		f.failures[r.URL.Path] = failures[1:]
+		s3ErrorResponse(w, failures[0], "InternalError", "We encountered an internal error. Please try again.")
+		return
+	}
+
+	if !f.buckets[strings.SplitN(r.URL.Path, "/", 3)[1]] {
+		s3ErrorResponse(w, http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist")
+		return
+	}
+	body, ok := f.objects[r.URL.Path]
+	if !ok {
+		s3ErrorResponse(w, http.StatusNotFound, "NoSuchKey", "The specified key does not exist.")
+		return
+	}
+	w.Write([]byte(body))
+}
+
+func s3ErrorResponse(w http.ResponseWriter, status int, code string, message string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, message)
+}
+
+// isolateAWSConfig keeps the AWS SDK from reading the environment's
+// credentials and config, returning a directory to write config files to.
+func isolateAWSConfig(t *testing.T) string {
+	t.Helper()
+
+	dir := tempDir(t)
+	for _, key := range []string{"AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY", "AWS_SESSION_TOKEN", "AWS_PROFILE", "AWS_REGION", "AWS_DEFAULT_REGION", "AWS_WEB_IDENTITY_TOKEN_FILE", "AWS_ROLE_ARN"} {
+		setenv(t, key, "")
+	}
+	setenv(t, "AWS_CONFIG_FILE", filepath.Join(dir, "config"))
+	setenv(t, "AWS_SHARED_CREDENTIALS_FILE", filepath.Join(dir, "credentials"))
+	setenv(t, "AWS_EC2_METADATA_DISABLED", "true")
+	return dir
+}
+
+// testS3Provider returns a provider that reads manifests from fake, with no
+// Buildkite token.
+func testS3Provider(t *testing.T, fake *fakeS3) *schema.Provider {
+	t.Helper()
+
+	isolateAWSConfig(t)
+	p := Provider("test")
+	diags := p.Configure(context.Background(), terraform.NewResourceConfigRaw(map[string]interface{}{
+		"manifest_source":      "s3://manifests/bfp",
+		"s3_endpoint":          fake.server.URL,
+		"s3_access_key_id":     fake.accessKeyID,
+		"s3_secret_access_key": "test-secret-key",
+		"max_backoff":          "1ms",
+	}))
+	requireNoErrors(t, diags)
+
+	return p
+}
+
+func TestDataStileManifestReadS3(t *testing.T) {
+	fake := newFakeS3(t)
+	fake.putObject("/manifests/bfp/5/"+testManifestName, testManifest)
+	p := testS3Provider(t, fake)
+
+	d, diags := readDataSource(t, p, "stile_manifest", map[string]interface{}{
+		"manifest_name":    testManifestName,
+		"bfp_build_number": 5,
+		"architecture":     "IntelLinux",
+	})
+	requireNoErrors(t, diags)
+
+	if got := d.Get("service_versions.stile-prober"); got != "prober-intel" {
+		t.Errorf("service_versions[stile-prober] = %q, want %q", got, "prober-intel")
+	}
+	if got := d.Id(); got != sha256Hex(testManifest) {
+		t.Errorf("id = %q, want the SHA-256 of the manifest", got)
+	}
+}
+
+func TestDataStileManifestReadS3Fallback(t *testing.T) {
+	fake := newFakeS3(t)
+	fake.putObject("/manifests/bfp/4/"+testManifestName, testFallbackManifest)
+	p := testS3Provider(t, fake)
+
+	d, diags := readDataSource(t, p, "stile_manifest", map[string]interface{}{
+		"manifest_name":         testManifestName,
+		"bfp_build_number":      5,
+		"fallback_build_number": 4,
+	})
+	requireNoErrors(t, diags)
+
+	if !hasWarning(diags, "Manifest untested-prober-service-manifest.json not found for build 5 in s3://manifests/bfp, using the one from build 4 in s3://manifests/bfp") {
+		t.Errorf("expected a fallback warning, got: %v", diags)
+	}
+	if got := d.Get("resolved_build_number"); got != 4 {
+		t.Errorf("resolved_build_number = %v, want 4", got)
+	}
+	if got := d.Id(); got != sha256Hex(testFallbackManifest) {
+		t.Errorf("id = %q, want the SHA-256 of the fallback manifest", got)
+	}
+}
+
+func TestDataStileManifestReadS3Errors(t *testing.T) {
+	fake := newFakeS3(t)
+	path := "/manifests/bfp/5/" + testManifestName
+	fake.putObject(path, testManifest)
+	fake.failNext(path, http.StatusServiceUnavailable, http.StatusInternalServerError)
+	p := testS3Provider(t, fake)
+
+	_, diags := readDataSource(t, p, "stile_manifest", map[string]interface{}{
+		"manifest_name":    testManifestName,
+		"bfp_build_number": 5,
+	})
+	requireNoErrors(t, diags)
+
+	// Not being allowed to read the object isn't the same as it not being
+	// there, so it doesn't fall back.
+	fake.mu.Lock()
+	fake.accessKeyID = "another-access-key"
+	fake.mu.Unlock()
+	_, diags = readDataSource(t, p, "stile_manifest", map[string]interface{}{
+		"manifest_name":         testManifestName,
+		"bfp_build_number":      5,
+		"fallback_build_number": 4,
+	})
+	requireError(t, diags, "Unable to fetch s3://manifests/bfp/5/"+testManifestName)
+	if !strings.Contains(diags[0].Detail, "AccessDenied: Access Denied") {
+		t.Errorf("expected the detail to say what S3 did, got: %s", diags[0].Detail)
+	}
+}
+
+func TestDataStileManifestReadS3NoSuchBucket(t *testing.T) {
+	fake := newFakeS3(t)
+	fake.putObject("/other-manifests/bfp/4/"+testManifestName, testFallbackManifest)
+	p := testS3Provider(t, fake)
+
+	// The bucket being wrong isn't the same as the build not having a
+	// manifest, so it doesn't fall back.
+	_, diags := readDataSource(t, p, "stile_manifest", map[string]interface{}{
+		"manifest_name":         testManifestName,
+		"bfp_build_number":      5,
+		"fallback_build_number": 4,
+	})
+	requireError(t, diags, "Unable to fetch s3://manifests/bfp/5/"+testManifestName)
+	if !strings.Contains(diags[0].Detail, "NoSuchBucket: The specified bucket does not exist") {
+		t.Errorf("expected the detail to say the bucket doesn't exist, got: %s", diags[0].Detail)
+	}
+}
+
+func TestDataStileManifestReadS3Credentials(t *testing.T) {
+	credentialsFile := `[manifests]
+aws_access_key_id = profile-access-key
+aws_secret_access_key = profile-secret-key
+`
+	configFile := `[profile manifests]
+region = ap-southeast-2
+`
+
+	tests := []struct {
+		name   string
+		env    map[string]string
+		config map[string]interface{}
+	}{
+		{
+			name:   "s3_profile",
+			config: map[string]interface{}{"s3_profile": "manifests"},
+		},
+		{
+			name: "AWS_PROFILE",
+			env:  map[string]string{"AWS_PROFILE": "manifests"},
+		},
+		{
+			name: "environment variables",
+			env: map[string]string{
+				"AWS_ACCESS_KEY_ID":     "profile-access-key",
+				"AWS_SECRET_ACCESS_KEY": "profile-secret-key",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeS3(t)
+			fake.accessKeyID = "profile-access-key"
+			fake.putObject("/manifests/bfp/5/"+testManifestName, testManifest)
+
+			dir := isolateAWSConfig(t)
+			if err := ioutil.WriteFile(filepath.Join(dir, "credentials"), []byte(credentialsFile), 0600); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(filepath.Join(dir, "config"), []byte(configFile), 0600); err != nil {
+				t.Fatal(err)
+			}
+			for key, value := range tt.env {
+				setenv(t, key, value)
+			}
+
+			config := map[string]interface{}{
+				"manifest_source": "s3://manifests/bfp",
+				"s3_endpoint":     fake.server.URL,
+			}
+			for key, value := range tt.config {
+				config[key] = value
+			}
+			p := Provider("test")
+			requireNoErrors(t, p.Configure(context.Background(), terraform.NewResourceConfigRaw(config)))
+
+			d, diags := readDataSource(t, p, "stile_manifest", map[string]interface{}{
+				"manifest_name":    testManifestName,
+				"bfp_build_number": 5,
+			})
+			requireNoErrors(t, diags)
+
+			if got := d.Id(); got != sha256Hex(testManifest) {
+				t.Errorf("id = %q, want the SHA-256 of the manifest", got)
+			}
+		})
+	}
+}
+
+func TestDataStileManifestReadS3UnknownProfile(t *testing.T) {
+	fake := newFakeS3(t)
+	isolateAWSConfig(t)
+
+	p := Provider("test")
+	requireNoErrors(t, p.Configure(context.Background(), terraform.NewResourceConfigRaw(map[string]interface{}{
+		"manifest_source": "s3://manifests/bfp",
+		"s3_endpoint":     fake.server.URL,
+		"s3_profile":      "missing",
+	})))
+
+	_, diags := readDataSource(t, p, "stile_manifest", map[string]interface{}{
+		"manifest_name":    testManifestName,
+		"bfp_build_number": 5,
+	})
+	requireError(t, diags, "Unable to fetch s3://manifests/bfp/5/"+testManifestName)
+}
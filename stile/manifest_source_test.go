@@ -0,0 +1,100 @@
+package stile
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hashicorp/terraform-plugin-sdk/v2/terraform"
+)
+
+// writeManifest writes a manifest to dir in the layout a
+// directoryManifestSource expects.
+func writeManifest(t *testing.T, dir string, buildNumber string, name string, body string) {
+	t.Helper()
+
+	if err := os.MkdirAll(filepath.Join(dir, buildNumber), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, buildNumber, name), []byte(body), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestParseManifestSource(t *testing.T) {
+	valid := []string{"", "buildkite", "file://manifests", "file:///tmp/manifests", "s3://manifests", "s3://manifests/bfp"}
+	for _, spec := range valid {
+		if _, err := parseManifestSource(nil, spec); err != nil {
+			t.Errorf("parseManifestSource(%q): %v", spec, err)
+		}
+	}
+
+	invalid := []string{"file://", "s3://", "s3:///bfp", "manifests", "Buildkite"}
+	for _, spec := range invalid {
+		if _, err := parseManifestSource(nil, spec); err == nil {
+			t.Errorf("parseManifestSource(%q) succeeded, want an error", spec)
+		}
+	}
+}
+
+func TestDataStileManifestReadDirectory(t *testing.T) {
+	dir := tempDir(t)
+	writeManifest(t, dir, "5", testManifestName, testManifest)
+
+	// No Buildkite token is needed.
+	p := Provider("test")
+	diags := p.Configure(context.Background(), terraform.NewResourceConfigRaw(map[string]interface{}{
+		"manifest_source": "file://" + dir,
+	}))
+	requireNoErrors(t, diags)
+
+	d, diags := readDataSource(t, p, "stile_manifest", map[string]interface{}{
+		"manifest_name":    testManifestName,
+		"bfp_build_number": 5,
+		"architecture":     "IntelLinux",
+	})
+	requireNoErrors(t, diags)
+
+	if got := d.Get("service_versions.stile-prober"); got != "prober-intel" {
+		t.Errorf("service_versions[stile-prober] = %q, want %q", got, "prober-intel")
+	}
+	if got := d.Id(); got != sha256Hex(testManifest) {
+		t.Errorf("id = %q, want the SHA-256 of the manifest", got)
+	}
+	if got := d.Get("resolved_build_number"); got != 5 {
+		t.Errorf("resolved_build_number = %v, want 5", got)
+	}
+	if got := d.Get("resolved_source"); got != manifestSourceBuild {
+		t.Errorf("resolved_source = %q, want %q", got, manifestSourceBuild)
+	}
+
+	_, diags = readDataSource(t, p, "stile_manifest", map[string]interface{}{
+		"manifest_name":    testManifestName,
+		"bfp_build_number": 6,
+	})
+	requireError(t, diags, "Manifest untested-prober-service-manifest.json not found for build 6 in "+dir)
+}
+
+func TestDataStileManifestReadDirectoryOverride(t *testing.T) {
+	fake := newFakeBuildkite(t)
+	fake.addArtifact(fake.addBuild(5), testManifestName, testFallbackManifest)
+	dir := tempDir(t)
+	writeManifest(t, dir, "5", testManifestName, testManifest)
+	p := testProvider(t, fake)
+
+	d, diags := readDataSource(t, p, "stile_manifest", map[string]interface{}{
+		"manifest_name":    testManifestName,
+		"bfp_build_number": 5,
+		"manifest_source":  "file://" + dir,
+	})
+	requireNoErrors(t, diags)
+
+	if got := d.Get("name"); got != "926993" {
+		t.Errorf("name = %q, want the manifest from the directory", got)
+	}
+	if got := fake.requestCount(fake.artifactsPath(5)); got != 0 {
+		t.Errorf("Buildkite was asked for the build's artifacts")
+	}
+}
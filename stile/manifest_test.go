@@ -0,0 +1,132 @@
+package stile
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDecodeManifestProblems(t *testing.T) {
+	tests := []struct {
+		name         string
+		manifest     string
+		architecture string
+		want         []string
+	}{
+		{
+			name:     "valid",
+			manifest: `{"name": "1", "amis": {}, "service_versions": {}}`,
+		},
+		{
+			name:     "not JSON",
+			manifest: `{"name": `,
+			want:     []string{"$: not valid JSON: unexpected EOF"},
+		},
+		{
+			name:     "not an object",
+			manifest: `["name"]`,
+			want:     []string{"$: expected object, got array"},
+		},
+		{
+			name:     "missing top-level fields",
+			manifest: `{}`,
+			want:     []string{"$.name: missing", "$.amis: missing", "$.service_versions: missing"},
+		},
+		{
+			name:         "architecture's fields are checked",
+			manifest:     `{"name": "1", "GravitonLinux": {"amis": {"base-ami": 7, "bastion-ami": null}}}`,
+			architecture: "GravitonLinux",
+			want: []string{
+				"$.GravitonLinux.amis.base-ami: expected string, got number",
+				"$.GravitonLinux.amis.bastion-ami: expected string, got null",
+				"$.GravitonLinux.service_versions: missing",
+			},
+		},
+		{
+			name:     "awkward keys are quoted",
+			manifest: `{"name": "1", "amis": {"base.ami": true}, "service_versions": []}`,
+			want:     []string{`$.amis["base.ami"]: expected string, got boolean`, "$.service_versions: expected object, got array"},
+		},
+		{
+			name:     "unsupported schema version",
+			manifest: `{"schema_version": 2}`,
+			want:     []string{"$.schema_version: version 2 isn't supported by this version of the provider, which supports versions 1 to 1"},
+		},
+		{
+			name:     "fractional schema version",
+			manifest: `{"name": "1", "schema_version": 1.5, "amis": {}, "service_versions": {}}`,
+			want:     []string{"$.schema_version: expected an integer, got number"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := decodeManifest(strings.NewReader(test.manifest), test.architecture)
+
+			var got []string
+			if err != nil {
+				var validationErr *manifestValidationError
+				if !errors.As(err, &validationErr) {
+					t.Fatalf("expected a *manifestValidationError, got %T: %v", err, err)
+				}
+				for _, problem := range validationErr.problems {
+					got = append(got, problem.String())
+				}
+			}
+
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got problems %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestManifestCanonicalJSON(t *testing.T) {
+	m, err := decodeManifest(strings.NewReader(`{
+  "service_versions": {},
+  "name": "1",
+  "amis": {"base-ami": "ami-1"},
+  "build_id": 12345678901234567891,
+  "ratio": 1.50,
+  "url": "https://buildkite.com/builds?branch=master&state=<passed>"
+}`), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := m.canonicalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := `{"amis":{"base-ami":"ami-1"},"build_id":12345678901234567891,"name":"1","ratio":1.50,"service_versions":{},"url":"https://buildkite.com/builds?branch=master&state=<passed>"}`
+	if got != want {
+		t.Errorf("canonicalJSON() = %s, want %s", got, want)
+	}
+}
+
+func TestResolveRegionalAMIs(t *testing.T) {
+	amis := map[string]string{
+		"base-ami":                "ami-default",
+		"base-ami:us-west-2":      "ami-usw2",
+		"bastion-ami:us-west-2":   "ami-bastion-usw2",
+		"bastion-ami:eu-west-1":   "ami-bastion-euw1",
+		"registry-ami":            "ami-registry",
+		"registry-ami:ap-south-1": "ami-registry-aps1",
+	}
+
+	got := resolveRegionalAMIs(amis, "us-west-2")
+	want := map[string]string{
+		"base-ami":     "ami-usw2",
+		"bastion-ami":  "ami-bastion-usw2",
+		"registry-ami": "ami-registry",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("resolveRegionalAMIs() = %v, want %v", got, want)
+	}
+
+	if got, want := amiRegions(amis), []string{"ap-south-1", "eu-west-1", "us-west-2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("amiRegions() = %v, want %v", got, want)
+	}
+}
@@ -1,15 +1,310 @@
 package stile
 
 import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/terraform-plugin-sdk/v2/diag"
 	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
 )
 
+const defaultBuildkiteBaseURL = "https://api.buildkite.com/"
+
 // Provider -
-func Provider() *schema.Provider {
-	return &schema.Provider{
+func Provider(version string) *schema.Provider {
+	p := &schema.Provider{
+		Schema: map[string]*schema.Schema{
+			// The Buildkite organisation and pipeline that produce the
+			// manifests. These default to Stile's own so existing
+			// configurations keep working with an empty provider block.
+			"buildkite_org": {
+				Type:     schema.TypeString,
+				Optional: true,
+				Default:  "stile-education",
+			},
+			"pipeline": {
+				Type:     schema.TypeString,
+				Optional: true,
+				Default:  "big-friendly-pipeline",
+			},
+			// The token isn't required here so that the provider can be
+			// configured without it (eg: by `terraform validate`). Data
+			// sources complain if they actually need to talk to Buildkite
+			// and don't have one.
+			"api_token": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				Sensitive:   true,
+				DefaultFunc: schema.EnvDefaultFunc("BUILDKITE_READ_API_TOKEN", nil),
+			},
+			// Mostly useful for pointing the provider at a fake Buildkite
+			// server.
+			"api_base_url": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				DefaultFunc: schema.EnvDefaultFunc("BUILDKITE_API_BASE_URL", defaultBuildkiteBaseURL),
+			},
+			// How hard to try when Buildkite has a transient failure,
+			// eg: a 5xx, a 429 or a network error. Other failures, like
+			// an invalid token, aren't retried.
+			"max_retries": {
+				Type:     schema.TypeInt,
+				Optional: true,
+				Default:  defaultMaxRetries,
+				ValidateFunc: func(v interface{}, k string) ([]string, []error) {
+					if v.(int) < 0 {
+						return nil, []error{fmt.Errorf("%q must not be negative, got %d", k, v.(int))}
+					}
+					return nil, nil
+				},
+			},
+			// The longest we'll wait between retries, as a Go duration
+			// string (eg: "30s"). If Buildkite's rate limit won't reset
+			// within this time we fail rather than wait.
+			"max_backoff": {
+				Type:     schema.TypeString,
+				Optional: true,
+				Default:  defaultMaxBackoff.String(),
+				ValidateFunc: func(v interface{}, k string) ([]string, []error) {
+					if _, err := time.ParseDuration(v.(string)); err != nil {
+						return nil, []error{fmt.Errorf("%q must be a duration, eg: \"30s\": %v", k, err)}
+					}
+					return nil, nil
+				},
+			},
+			// ed25519 public keys trusted to sign manifests, either PEM
+			// encoded or the base64 encoded raw key. See signature.go.
+			"manifest_public_keys": {
+				Type:     schema.TypeList,
+				Optional: true,
+				Elem: &schema.Schema{
+					Type: schema.TypeString,
+				},
+			},
+			// Where builds' manifests come from: "buildkite",
+			// "file://<dir>" for a directory laid out like
+			// <dir>/<build_number>/<manifest_name>, or
+			// "s3://<bucket>/<prefix>" for a bucket laid out the same way.
+			// Data sources can override this.
+			"manifest_source": {
+				Type:         schema.TypeString,
+				Optional:     true,
+				Default:      manifestSourceSpecBuildkite,
+				ValidateFunc: validateManifestSource,
+			},
+			// How to reach S3 for "s3://" manifest sources. Anything not
+			// set here comes from the AWS SDK's default chain, as for the
+			// AWS CLI: AWS_* environment variables, ~/.aws/config and
+			// ~/.aws/credentials (including SSO profiles), web identity
+			// tokens and instance or task roles. s3_endpoint points at
+			// something else that talks S3, eg: MinIO.
+			"s3_endpoint": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				DefaultFunc: schema.EnvDefaultFunc("AWS_ENDPOINT_URL_S3", nil),
+			},
+			"s3_region": {
+				Type:     schema.TypeString,
+				Optional: true,
+			},
+			"s3_profile": {
+				Type:     schema.TypeString,
+				Optional: true,
+			},
+			"s3_access_key_id": {
+				Type:     schema.TypeString,
+				Optional: true,
+			},
+			"s3_secret_access_key": {
+				Type:      schema.TypeString,
+				Optional:  true,
+				Sensitive: true,
+			},
+			"s3_session_token": {
+				Type:      schema.TypeString,
+				Optional:  true,
+				Sensitive: true,
+			},
+			// Where to keep downloaded artifacts, so that builds that
+			// have been seen before are available without Buildkite. See
+			// disk_cache.go.
+			"cache_dir": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				DefaultFunc: schema.EnvDefaultFunc("STILE_CACHE_DIR", nil),
+			},
+			// Only use what's in cache_dir, never Buildkite. This can also
+			// be turned on with the STILE_OFFLINE environment variable.
+			"offline": {
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  false,
+			},
+			// Fail any stile_manifest read that can't verify the
+			// manifest's signature, rather than only those that ask for
+			// it with verify_signature.
+			"require_signed_manifests": {
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  false,
+			},
+		},
 		ResourcesMap: map[string]*schema.Resource{},
 		DataSourcesMap: map[string]*schema.Resource{
-			"stile_manifest": dataStileManifest(),
+			"stile_manifest":            dataStileManifest(),
+			"stile_manifest_diff":       dataStileManifestDiff(),
+			"stile_build":               dataStileBuild(),
+			"stile_buildkite_artifact":  dataStileBuildkiteArtifact(),
+			"stile_buildkite_artifacts": dataStileBuildkiteArtifacts(),
 		},
 	}
+
+	p.ConfigureContextFunc = func(ctx context.Context, d *schema.ResourceData) (interface{}, diag.Diagnostics) {
+		return providerConfigure(ctx, d, p.UserAgent("terraform-provider-stile", version))
+	}
+
+	return p
+}
+
+func providerConfigure(ctx context.Context, d *schema.ResourceData, userAgent string) (interface{}, diag.Diagnostics) {
+	rawBaseURL := d.Get("api_base_url").(string)
+	// The Buildkite client resolves request paths relative to the base
+	// URL, so without a trailing slash the last path segment would be
+	// dropped.
+	if !strings.HasSuffix(rawBaseURL, "/") {
+		rawBaseURL += "/"
+	}
+
+	baseURL, err := url.Parse(rawBaseURL)
+	if err != nil || baseURL.Scheme == "" || baseURL.Host == "" {
+		return nil, diag.Diagnostics{
+			diag.Diagnostic{
+				Severity: diag.Error,
+				Summary:  fmt.Sprintf("Invalid api_base_url %q", d.Get("api_base_url")),
+				Detail:   "api_base_url must be an absolute URL, eg: https://api.buildkite.com/",
+			},
+		}
+	}
+
+	c := &stileClient{
+		org:       d.Get("buildkite_org").(string),
+		pipeline:  d.Get("pipeline").(string),
+		http:      &http.Client{Timeout: 2 * time.Minute},
+		artifacts: newArtifactCache(),
+	}
+
+	for i, key := range d.Get("manifest_public_keys").([]interface{}) {
+		publicKey, err := parseManifestPublicKey(key.(string))
+		if err != nil {
+			return nil, diag.Diagnostics{
+				diag.Diagnostic{
+					Severity: diag.Error,
+					Summary:  fmt.Sprintf("Invalid manifest_public_keys[%d]", i),
+					Detail:   err.Error(),
+				},
+			}
+		}
+		c.manifestPublicKeys = append(c.manifestPublicKeys, publicKey)
+	}
+
+	c.requireSignedManifests = d.Get("require_signed_manifests").(bool)
+	if c.requireSignedManifests && len(c.manifestPublicKeys) == 0 {
+		return nil, diag.Diagnostics{
+			diag.Diagnostic{
+				Severity: diag.Error,
+				Summary:  "require_signed_manifests is set but there are no manifest_public_keys",
+				Detail:   "No manifest could ever be verified. Add the public keys that sign manifests to manifest_public_keys.",
+			},
+		}
+	}
+
+	// Already checked by the schema's ValidateFunc.
+	maxBackoff, _ := time.ParseDuration(d.Get("max_backoff").(string))
+	c.retry = retryPolicy{
+		maxRetries:  d.Get("max_retries").(int),
+		baseBackoff: time.Second,
+		maxBackoff:  maxBackoff,
+	}
+
+	c.s3 = &s3Config{
+		endpoint:        d.Get("s3_endpoint").(string),
+		region:          d.Get("s3_region").(string),
+		profile:         d.Get("s3_profile").(string),
+		accessKeyID:     d.Get("s3_access_key_id").(string),
+		secretAccessKey: d.Get("s3_secret_access_key").(string),
+		sessionToken:    d.Get("s3_session_token").(string),
+	}
+	if c.s3.endpoint != "" {
+		endpoint, err := url.Parse(c.s3.endpoint)
+		if err != nil || endpoint.Scheme == "" || endpoint.Host == "" {
+			return nil, diag.Diagnostics{
+				diag.Diagnostic{
+					Severity: diag.Error,
+					Summary:  fmt.Sprintf("Invalid s3_endpoint %q", c.s3.endpoint),
+					Detail:   "s3_endpoint must be an absolute URL, eg: http://localhost:9000",
+				},
+			}
+		}
+	}
+	if (c.s3.accessKeyID == "") != (c.s3.secretAccessKey == "") {
+		return nil, diag.Diagnostics{
+			diag.Diagnostic{
+				Severity: diag.Error,
+				Summary:  "Only one of s3_access_key_id and s3_secret_access_key is set",
+				Detail:   "Set both to use static credentials for S3, or neither to use the AWS SDK's default credential chain.",
+			},
+		}
+	}
+
+	// Already checked by the schema's ValidateFunc.
+	c.manifestSource, _ = parseManifestSource(c, d.Get("manifest_source").(string))
+
+	if cacheDir := d.Get("cache_dir").(string); cacheDir != "" {
+		c.cache = &diskCache{dir: cacheDir}
+	}
+
+	c.offline = d.Get("offline").(bool)
+	if offline, ok := os.LookupEnv("STILE_OFFLINE"); ok && offline != "" {
+		c.offline, err = strconv.ParseBool(offline)
+		if err != nil {
+			return nil, diag.Diagnostics{
+				diag.Diagnostic{
+					Severity: diag.Error,
+					Summary:  "Invalid value for environment variable STILE_OFFLINE",
+					Detail:   fmt.Sprintf("It must be a valid boolean value (e.g. 0, 1, true, false, etc.): %v", err),
+				},
+			}
+		}
+	}
+	if c.offline && c.cache == nil {
+		return nil, diag.Diagnostics{
+			diag.Diagnostic{
+				Severity: diag.Error,
+				Summary:  "The provider is offline but there's no cache_dir",
+				Detail:   "Offline, manifests can only come from the cache. Set cache_dir (or STILE_CACHE_DIR) to where they were cached.",
+			},
+		}
+	}
+
+	if apiToken := d.Get("api_token").(string); apiToken != "" {
+		client, err := newBuildkiteClient(apiToken, baseURL, userAgent, c.retry.maxBackoff)
+		if err != nil {
+			return nil, diag.Diagnostics{
+				diag.Diagnostic{
+					Severity: diag.Error,
+					Summary:  "Unable to configure Buildkite Client with api_token",
+					Detail:   fmt.Sprintf("client config failed: %v", err),
+				},
+			}
+		}
+		c.buildkite = client
+	}
+
+	return c, nil
 }
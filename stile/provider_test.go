@@ -0,0 +1,152 @@
+package stile
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/hashicorp/terraform-plugin-sdk/v2/diag"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/terraform"
+)
+
+func TestProvider(t *testing.T) {
+	if err := Provider("test").InternalValidate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestProviderConfigureInvalidBaseURL(t *testing.T) {
+	p := Provider("test")
+	diags := p.Configure(context.Background(), terraform.NewResourceConfigRaw(map[string]interface{}{
+		"api_base_url": "not a url",
+	}))
+	if !diags.HasError() {
+		t.Fatal("expected an error for an invalid api_base_url")
+	}
+}
+
+func TestDataSourcesRequireBuildkiteToken(t *testing.T) {
+	setenv(t, "BUILDKITE_READ_API_TOKEN", "")
+	p := Provider("test")
+	requireNoErrors(t, p.Configure(context.Background(), terraform.NewResourceConfigRaw(map[string]interface{}{})))
+
+	tests := map[string]map[string]interface{}{
+		"stile_build":               {"branch": "master"},
+		"stile_buildkite_artifact":  {"build_number": 5, "filename": "artifact.txt"},
+		"stile_buildkite_artifacts": {"build_number": 5},
+		"stile_manifest":            {"manifest_name": "manifest.json", "bfp_build_number": 5},
+	}
+	for name, raw := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, diags := readDataSource(t, p, name, raw)
+			requireError(t, diags, "Unable to find a Buildkite API token.")
+		})
+	}
+}
+
+// testProvider returns a provider configured to talk to fake, retrying
+// quickly so that tests of retries don't take long.
+func testProvider(t *testing.T, fake *fakeBuildkite) *schema.Provider {
+	t.Helper()
+
+	return testProviderWithConfig(t, fake, nil)
+}
+
+// testProviderWithConfig is testProvider with extra provider arguments.
+func testProviderWithConfig(t *testing.T, fake *fakeBuildkite, extra map[string]interface{}) *schema.Provider {
+	t.Helper()
+
+	config := map[string]interface{}{
+		"buildkite_org": fake.org,
+		"pipeline":      fake.pipeline,
+		"api_token":     fake.token,
+		"api_base_url":  fake.URL(),
+		"max_backoff":   "1ms",
+	}
+	for k, v := range extra {
+		config[k] = v
+	}
+
+	p := Provider("test")
+	diags := p.Configure(context.Background(), terraform.NewResourceConfigRaw(config))
+	if diags.HasError() {
+		t.Fatalf("configuring provider: %v", diags)
+	}
+
+	return p
+}
+
+// readDataSource reads the named data source with the given configuration.
+func readDataSource(t *testing.T, p *schema.Provider, name string, raw map[string]interface{}) (*schema.ResourceData, diag.Diagnostics) {
+	t.Helper()
+
+	ds := p.DataSourcesMap[name]
+	d := schema.TestResourceDataRaw(t, ds.Schema, raw)
+	return d, ds.ReadContext(context.Background(), d, p.Meta())
+}
+
+// planDataSource reads the named data source the way the SDK's gRPC server
+// does for a terraform plan: diffing the configuration against no state at
+// all, as Terraform never gives data sources their previous state, and
+// then applying that diff.
+func planDataSource(t *testing.T, p *schema.Provider, name string, raw map[string]interface{}) (*schema.ResourceData, diag.Diagnostics) {
+	t.Helper()
+
+	ds := p.DataSourcesMap[name]
+	diff, err := ds.Diff(context.Background(), nil, terraform.NewResourceConfigRaw(raw), p.Meta())
+	if err != nil {
+		t.Fatalf("diffing %s: %v", name, err)
+	}
+	state, diags := ds.ReadDataApply(context.Background(), diff, p.Meta())
+	return ds.Data(state), diags
+}
+
+// setenv sets an environment variable for the rest of the test.
+func setenv(t *testing.T, key string, value string) {
+	t.Helper()
+
+	previous, ok := os.LookupEnv(key)
+	if err := os.Setenv(key, value); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if ok {
+			os.Setenv(key, previous)
+		} else {
+			os.Unsetenv(key)
+		}
+	})
+}
+
+// requireNoErrors fails the test if diags has any errors.
+func requireNoErrors(t *testing.T, diags diag.Diagnostics) {
+	t.Helper()
+
+	if diags.HasError() {
+		t.Fatalf("unexpected errors: %v", diags)
+	}
+}
+
+// requireError fails the test unless diags has an error whose summary is
+// summary.
+func requireError(t *testing.T, diags diag.Diagnostics, summary string) {
+	t.Helper()
+
+	for _, d := range diags {
+		if d.Severity == diag.Error && d.Summary == summary {
+			return
+		}
+	}
+	t.Fatalf("expected an error %q, got: %v", summary, diags)
+}
+
+// hasWarning reports whether diags has a warning whose summary is summary.
+func hasWarning(diags diag.Diagnostics, summary string) bool {
+	for _, d := range diags {
+		if d.Severity == diag.Warning && d.Summary == summary {
+			return true
+		}
+	}
+	return false
+}
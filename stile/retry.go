@@ -0,0 +1,225 @@
+package stile
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/buildkite/go-buildkite/v2/buildkite"
+)
+
+// retryPolicy decides which failed Buildkite requests are worth retrying,
+// and how long to wait between attempts.
+//
+// Don't make this too generous because it makes legit failures take a
+// really long time to surface. When Terraform is running this provider the
+// user doesn't see any logs, so it will just appear that the provider is
+// hanging and hanging and hanging...
+type retryPolicy struct {
+	maxRetries  int
+	baseBackoff time.Duration
+	maxBackoff  time.Duration
+}
+
+const (
+	defaultMaxRetries = 4
+	defaultMaxBackoff = 30 * time.Second
+)
+
+// do calls op until it succeeds, returns an error that isn't worth
+// retrying, runs out of retries or ctx is done.
+func (p retryPolicy) do(ctx context.Context, op func() error) error {
+	for attempt := 0; ; attempt++ {
+		err := op()
+		if err == nil {
+			return nil
+		}
+
+		retry, wait := p.classify(err, attempt)
+		if !retry || attempt >= p.maxRetries {
+			return err
+		}
+
+		log.Printf("[DEBUG] Buildkite request failed (attempt %d of %d), retrying in %s: %v", attempt+1, p.maxRetries+1, wait, err)
+
+		if err := sleepContext(ctx, wait); err != nil {
+			return err
+		}
+	}
+}
+
+// classify reports whether err is worth retrying and, if so, how long to
+// wait before the next attempt.
+func (p retryPolicy) classify(err error, attempt int) (bool, time.Duration) {
+	if isContextError(err) {
+		return false, 0
+	}
+
+	var rateLimited *rateLimitError
+	if errors.As(err, &rateLimited) {
+		// Buildkite told us exactly when to come back. If that's further
+		// away than we're willing to wait then give up now rather than
+		// sit there until the read times out.
+		if rateLimited.retryAfter > p.maxBackoff {
+			return false, 0
+		}
+		if rateLimited.retryAfter > 0 {
+			return true, rateLimited.retryAfter
+		}
+		return true, p.backoff(attempt)
+	}
+
+	var errorResponse *buildkite.ErrorResponse
+	if errors.As(err, &errorResponse) {
+		switch code := errorResponse.Response.StatusCode; {
+		case code == http.StatusRequestTimeout, code == http.StatusTooManyRequests, code >= 500:
+			return true, p.backoff(attempt)
+		default:
+			// Anything else in the 4xx range, eg: a bad token (401) or
+			// one without access to the pipeline (403), won't be fixed by
+			// asking again.
+			return false, 0
+		}
+	}
+
+	// The same goes for manifests fetched from a URL.
+	var urlErr *manifestURLError
+	if errors.As(err, &urlErr) {
+		switch code := urlErr.statusCode; {
+		case code == http.StatusRequestTimeout, code == http.StatusTooManyRequests, code >= 500:
+			return true, p.backoff(attempt)
+		default:
+			return false, 0
+		}
+	}
+
+	// A truncated download is worth another go. If it was tampered with
+	// then it'll fail again and we'll report it.
+	var integrityErr *artifactIntegrityError
+	if errors.As(err, &integrityErr) {
+		return true, p.backoff(attempt)
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true, p.backoff(attempt)
+	}
+
+	return false, 0
+}
+
+// backoff returns a jittered, exponentially increasing wait for the given
+// attempt, capped at maxBackoff.
+func (p retryPolicy) backoff(attempt int) time.Duration {
+	wait := p.baseBackoff
+	for i := 0; i < attempt && wait < p.maxBackoff; i++ {
+		wait *= 2
+	}
+	if wait > p.maxBackoff {
+		wait = p.maxBackoff
+	}
+
+	// Wait somewhere between half and all of it so that data sources
+	// failing together don't all come back at once.
+	half := int64(wait / 2)
+	return time.Duration(half + rand.Int63n(half+1))
+}
+
+// rateLimitError is returned, instead of a response, for requests that
+// Buildkite rejected with 429 Too Many Requests.
+type rateLimitError struct {
+	retryAfter time.Duration
+}
+
+func (e *rateLimitError) Error() string {
+	if e.retryAfter > 0 {
+		return fmt.Sprintf("Buildkite API rate limit exceeded, it resets in %s", e.retryAfter)
+	}
+	return "Buildkite API rate limit exceeded"
+}
+
+// rateLimitTransport makes requests rate-limit aware. It holds back
+// requests once Buildkite reports that we've used up the current rate limit
+// window, and turns 429 responses into a rateLimitError.
+//
+// The latter stops the go-buildkite client from retrying 429s itself:
+// it does so with its own backoff which ignores both the request's context
+// and the rate limit headers, for up to 15 minutes.
+type rateLimitTransport struct {
+	next http.RoundTripper
+	// The longest we'll hold a request back, the retryPolicy's
+	// maxBackoff. If the rate limit won't reset by then the request fails
+	// with a rateLimitError instead, which isn't retried.
+	maxWait time.Duration
+
+	mu       sync.Mutex
+	resumeAt time.Time
+}
+
+func (t *rateLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.mu.Lock()
+	wait := time.Until(t.resumeAt)
+	t.mu.Unlock()
+
+	if wait > t.maxWait {
+		return nil, &rateLimitError{retryAfter: wait}
+	}
+	if wait > 0 {
+		log.Printf("[DEBUG] Buildkite API rate limit exhausted, waiting %s", wait)
+		if err := sleepContext(req.Context(), wait); err != nil {
+			return nil, err
+		}
+	}
+
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	reset := parseRateLimitReset(resp.Header)
+
+	if resp.Header.Get("RateLimit-Remaining") == "0" && reset > 0 {
+		t.mu.Lock()
+		t.resumeAt = time.Now().Add(reset)
+		t.mu.Unlock()
+	}
+
+	if resp.StatusCode == http.StatusTooManyRequests {
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		return nil, &rateLimitError{retryAfter: reset}
+	}
+
+	return resp, nil
+}
+
+// parseRateLimitReset returns how long until the server will accept
+// requests again, preferring the standard Retry-After header over
+// Buildkite's RateLimit-Reset. It's 0 if the headers don't say.
+func parseRateLimitReset(h http.Header) time.Duration {
+	if retryAfter := h.Get("Retry-After"); retryAfter != "" {
+		if seconds, err := strconv.Atoi(retryAfter); err == nil {
+			return time.Duration(seconds) * time.Second
+		}
+		if at, err := http.ParseTime(retryAfter); err == nil {
+			return time.Until(at)
+		}
+	}
+
+	if reset := h.Get("RateLimit-Reset"); reset != "" {
+		if seconds, err := strconv.Atoi(reset); err == nil {
+			return time.Duration(seconds) * time.Second
+		}
+	}
+
+	return 0
+}
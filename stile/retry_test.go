@@ -0,0 +1,232 @@
+package stile
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/buildkite/go-buildkite/v2/buildkite"
+)
+
+func buildkiteErrorResponse(status int) error {
+	return &buildkite.ErrorResponse{Response: &http.Response{StatusCode: status}}
+}
+
+func TestRetryPolicyClassify(t *testing.T) {
+	p := retryPolicy{maxRetries: 4, baseBackoff: time.Second, maxBackoff: 30 * time.Second}
+
+	tests := []struct {
+		name  string
+		err   error
+		retry bool
+		// The exact wait, if it's not a jittered backoff.
+		wait time.Duration
+	}{
+		{"bad token", buildkiteErrorResponse(http.StatusUnauthorized), false, 0},
+		{"no access", buildkiteErrorResponse(http.StatusForbidden), false, 0},
+		{"not found", buildkiteErrorResponse(http.StatusNotFound), false, 0},
+		{"request timeout", buildkiteErrorResponse(http.StatusRequestTimeout), true, 0},
+		{"too many requests", buildkiteErrorResponse(http.StatusTooManyRequests), true, 0},
+		{"server error", buildkiteErrorResponse(http.StatusInternalServerError), true, 0},
+		{"unavailable", buildkiteErrorResponse(http.StatusServiceUnavailable), true, 0},
+		{"wrapped server error", fmt.Errorf("listing artifacts: %w", buildkiteErrorResponse(http.StatusBadGateway)), true, 0},
+		{"URL forbidden", &manifestURLError{statusCode: http.StatusForbidden}, false, 0},
+		{"URL request timeout", &manifestURLError{statusCode: http.StatusRequestTimeout}, true, 0},
+		{"URL too many requests", &manifestURLError{statusCode: http.StatusTooManyRequests}, true, 0},
+		{"URL server error", &manifestURLError{statusCode: http.StatusInternalServerError}, true, 0},
+		{"rate limited until soon", &rateLimitError{retryAfter: 5 * time.Second}, true, 5 * time.Second},
+		{"rate limited until after max_backoff", &rateLimitError{retryAfter: time.Minute}, false, 0},
+		{"rate limited with no reset", &rateLimitError{}, true, 0},
+		{"truncated download", &artifactIntegrityError{field: "size"}, true, 0},
+		{"network error", &net.OpError{Op: "dial", Err: errors.New("connection refused")}, true, 0},
+		{"unexpected EOF", io.ErrUnexpectedEOF, true, 0},
+		{"cancelled", context.Canceled, false, 0},
+		{"timed out", fmt.Errorf("listing artifacts: %w", context.DeadlineExceeded), false, 0},
+		{"anything else", errors.New("boom"), false, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			retry, wait := p.classify(test.err, 0)
+			if retry != test.retry {
+				t.Fatalf("retry = %v, want %v", retry, test.retry)
+			}
+			switch {
+			case !retry && wait != 0:
+				t.Errorf("wait = %s, want 0 when not retrying", wait)
+			case retry && test.wait != 0 && wait != test.wait:
+				t.Errorf("wait = %s, want %s", wait, test.wait)
+			case retry && test.wait == 0 && (wait < p.baseBackoff/2 || wait > p.baseBackoff):
+				t.Errorf("wait = %s, want a backoff between %s and %s", wait, p.baseBackoff/2, p.baseBackoff)
+			}
+		})
+	}
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	p := retryPolicy{baseBackoff: time.Second, maxBackoff: 10 * time.Second}
+
+	caps := []time.Duration{1, 2, 4, 8, 10, 10, 10}
+	for attempt, limit := range caps {
+		limit *= time.Second
+		for i := 0; i < 100; i++ {
+			if wait := p.backoff(attempt); wait < limit/2 || wait > limit {
+				t.Fatalf("backoff(%d) = %s, want between %s and %s", attempt, wait, limit/2, limit)
+			}
+		}
+	}
+
+	// Enough attempts to overflow if the doubling weren't capped.
+	if wait := p.backoff(100); wait < p.maxBackoff/2 || wait > p.maxBackoff {
+		t.Errorf("backoff(100) = %s, want between %s and %s", wait, p.maxBackoff/2, p.maxBackoff)
+	}
+}
+
+func TestRetryPolicyDo(t *testing.T) {
+	p := retryPolicy{maxRetries: 2, baseBackoff: time.Millisecond, maxBackoff: time.Millisecond}
+
+	tests := []struct {
+		name     string
+		err      error
+		attempts int
+	}{
+		{"retryable", buildkiteErrorResponse(http.StatusServiceUnavailable), 3},
+		{"not retryable", buildkiteErrorResponse(http.StatusUnauthorized), 1},
+		{"rate limited for longer than max_backoff", &rateLimitError{retryAfter: time.Minute}, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			attempts := 0
+			err := p.do(context.Background(), func() error {
+				attempts++
+				return test.err
+			})
+			if err != test.err {
+				t.Errorf("do() = %v, want %v", err, test.err)
+			}
+			if attempts != test.attempts {
+				t.Errorf("%d attempts, want %d", attempts, test.attempts)
+			}
+		})
+	}
+
+	attempts := 0
+	err := p.do(context.Background(), func() error {
+		attempts++
+		if attempts < 2 {
+			return io.ErrUnexpectedEOF
+		}
+		return nil
+	})
+	if err != nil || attempts != 2 {
+		t.Errorf("do() = %v after %d attempts, want success after 2", err, attempts)
+	}
+}
+
+func TestParseRateLimitReset(t *testing.T) {
+	tests := []struct {
+		name   string
+		header http.Header
+		want   time.Duration
+	}{
+		{"none", http.Header{}, 0},
+		{"Retry-After seconds", http.Header{"Retry-After": {"7"}}, 7 * time.Second},
+		{"RateLimit-Reset", http.Header{"Ratelimit-Reset": {"12"}}, 12 * time.Second},
+		{"Retry-After wins", http.Header{"Retry-After": {"3"}, "Ratelimit-Reset": {"12"}}, 3 * time.Second},
+		{"invalid Retry-After falls back", http.Header{"Retry-After": {"soon"}, "Ratelimit-Reset": {"12"}}, 12 * time.Second},
+		{"invalid", http.Header{"Ratelimit-Reset": {"soon"}}, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := parseRateLimitReset(test.header); got != test.want {
+				t.Errorf("parseRateLimitReset = %s, want %s", got, test.want)
+			}
+		})
+	}
+
+	// HTTP dates only have a resolution of a second.
+	at := time.Now().Add(30 * time.Second)
+	got := parseRateLimitReset(http.Header{"Retry-After": {at.UTC().Format(http.TimeFormat)}})
+	if got < 28*time.Second || got > 30*time.Second {
+		t.Errorf("parseRateLimitReset of an HTTP date 30s away = %s", got)
+	}
+}
+
+// roundTripFunc is an http.RoundTripper that calls itself.
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestRateLimitTransport(t *testing.T) {
+	var header http.Header
+	status := http.StatusOK
+	requests := 0
+	transport := &rateLimitTransport{maxWait: time.Minute, next: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		requests++
+		return &http.Response{StatusCode: status, Header: header, Body: http.NoBody}, nil
+	})}
+
+	request := func(ctx context.Context) (*http.Response, error) {
+		req, err := http.NewRequest("GET", "https://api.buildkite.com/v2/builds", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return transport.RoundTrip(req.WithContext(ctx))
+	}
+
+	// Using up the rate limit holds back the next request until it
+	// resets, or the request gives up.
+	header = http.Header{"Ratelimit-Remaining": {"0"}, "Ratelimit-Reset": {"60"}}
+	if _, err := request(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := request(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("request while rate limited = %v, want context.DeadlineExceeded", err)
+	}
+	if requests != 1 {
+		t.Errorf("%d requests were sent, want 1", requests)
+	}
+
+	// Nor is it held back for longer than maxWait; it fails straight
+	// away with an error that isn't retried.
+	transport.maxWait = 30 * time.Second
+	start := time.Now()
+	var rateLimited *rateLimitError
+	if _, err := request(context.Background()); !errors.As(err, &rateLimited) || rateLimited.retryAfter <= 30*time.Second {
+		t.Errorf("request while rate limited for longer than maxWait = %v, want a rateLimitError with a retryAfter over 30s", err)
+	}
+	if waited := time.Since(start); waited > time.Second {
+		t.Errorf("request was held back for %s, want it to fail straight away", waited)
+	}
+	if retry, _ := (retryPolicy{maxBackoff: 30 * time.Second}).classify(rateLimited, 0); retry {
+		t.Error("a rate limit that won't reset within maxBackoff was retried")
+	}
+	if requests != 1 {
+		t.Errorf("%d requests were sent, want 1", requests)
+	}
+
+	transport.resumeAt = time.Now().Add(50 * time.Millisecond)
+	header = http.Header{"Ratelimit-Remaining": {"10"}}
+	start = time.Now()
+	if _, err := request(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if waited := time.Since(start); waited < 50*time.Millisecond {
+		t.Errorf("request was held back for %s, want at least 50ms", waited)
+	}
+
+	// A 429 becomes a rateLimitError saying when to come back.
+	status = http.StatusTooManyRequests
+	header = http.Header{"Retry-After": {"5"}}
+	if _, err := request(context.Background()); !errors.As(err, &rateLimited) || rateLimited.retryAfter != 5*time.Second {
+		t.Errorf("request = %v, want a rateLimitError with a retryAfter of 5s", err)
+	}
+}
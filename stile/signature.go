@@ -0,0 +1,90 @@
+package stile
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Manifests can be signed with a detached ed25519 signature, uploaded as a
+// sibling artifact of the manifest (by default "<manifest_name>.sig"). The
+// signature is over the manifest exactly as uploaded, and may be either the
+// raw 64 bytes or base64 encoded, eg:
+//
+//	openssl pkeyutl -sign -rawin -inkey key.pem -in manifest.json | base64
+//
+// The public keys that are trusted to sign manifests are set in the
+// provider block.
+
+// parseManifestPublicKey accepts either a PEM encoded "PUBLIC KEY", as
+// written by `openssl pkey -pubout`, or the base64 encoded raw 32 byte key.
+func parseManifestPublicKey(key string) (ed25519.PublicKey, error) {
+	key = strings.TrimSpace(key)
+
+	if strings.HasPrefix(key, "-----BEGIN") {
+		block, _ := pem.Decode([]byte(key))
+		if block == nil {
+			return nil, errors.New("invalid PEM block")
+		}
+		parsed, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		publicKey, ok := parsed.(ed25519.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("expected an ed25519 key, got %T", parsed)
+		}
+		return publicKey, nil
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return nil, fmt.Errorf("expected a PEM or base64 encoded key: %w", err)
+	}
+	if len(raw) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("expected a %d byte ed25519 key, got %d bytes", ed25519.PublicKeySize, len(raw))
+	}
+	return ed25519.PublicKey(raw), nil
+}
+
+// decodeManifestSignature accepts either the raw signature or its base64
+// encoding.
+func decodeManifestSignature(signature []byte) ([]byte, error) {
+	if len(signature) == ed25519.SignatureSize {
+		return signature, nil
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(signature)))
+	if err != nil {
+		return nil, fmt.Errorf("expected a raw or base64 encoded signature: %w", err)
+	}
+	if len(decoded) != ed25519.SignatureSize {
+		return nil, fmt.Errorf("expected a %d byte ed25519 signature, got %d bytes", ed25519.SignatureSize, len(decoded))
+	}
+	return decoded, nil
+}
+
+// verifyManifestSignature checks that one of keys signed manifest.
+func verifyManifestSignature(keys []ed25519.PublicKey, manifest []byte, signature []byte) error {
+	if len(keys) == 0 {
+		return errors.New("no manifest_public_keys are configured in the provider block")
+	}
+
+	decoded, err := decodeManifestSignature(signature)
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		if ed25519.Verify(key, manifest, decoded) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("the signature doesn't match any of the %d configured manifest_public_keys", len(keys))
+}
@@ -0,0 +1,207 @@
+package stile
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"strings"
+	"testing"
+)
+
+// testSigningKey returns a new ed25519 key pair, with the public key
+// encoded for manifest_public_keys.
+func testSigningKey(t *testing.T) (string, ed25519.PrivateKey) {
+	t.Helper()
+
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(publicKey), privateKey
+}
+
+// signManifest returns the base64 encoded signature of manifest.
+func signManifest(privateKey ed25519.PrivateKey, manifest string) string {
+	return base64.StdEncoding.EncodeToString(ed25519.Sign(privateKey, []byte(manifest)))
+}
+
+func TestParseManifestPublicKey(t *testing.T) {
+	publicKey, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	valid := map[string]string{
+		"base64": base64.StdEncoding.EncodeToString(publicKey),
+		"PEM":    string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})),
+	}
+	for name, key := range valid {
+		parsed, err := parseManifestPublicKey("\n" + key + "\n")
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+		} else if !bytes.Equal(parsed, publicKey) {
+			t.Errorf("%s: parsed a different key", name)
+		}
+	}
+
+	invalid := map[string]string{
+		"not base64":  "not a key!",
+		"wrong size":  base64.StdEncoding.EncodeToString(publicKey[:16]),
+		"invalid PEM": "-----BEGIN PUBLIC KEY-----\nnope\n",
+	}
+	for name, key := range invalid {
+		if _, err := parseManifestPublicKey(key); err == nil {
+			t.Errorf("%s: parsed %q without an error", name, key)
+		}
+	}
+}
+
+func TestVerifyManifestSignature(t *testing.T) {
+	encodedKey, privateKey := testSigningKey(t)
+	publicKey, err := parseManifestPublicKey(encodedKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	manifest := []byte(testManifest)
+	raw := ed25519.Sign(privateKey, manifest)
+
+	tests := []struct {
+		name      string
+		keys      []ed25519.PublicKey
+		manifest  []byte
+		signature []byte
+		wantErr   string
+	}{
+		{"raw", []ed25519.PublicKey{publicKey}, manifest, raw, ""},
+		{"base64", []ed25519.PublicKey{publicKey}, manifest, []byte(base64.StdEncoding.EncodeToString(raw) + "\n"), ""},
+		{"any key", []ed25519.PublicKey{otherKey, publicKey}, manifest, raw, ""},
+		{"tampered", []ed25519.PublicKey{publicKey}, []byte(testFallbackManifest), raw, "doesn't match any of the 1 configured"},
+		{"wrong key", []ed25519.PublicKey{otherKey}, manifest, raw, "doesn't match"},
+		{"no keys", nil, manifest, raw, "no manifest_public_keys"},
+		{"garbage", []ed25519.PublicKey{publicKey}, manifest, []byte("not a signature"), "expected a raw or base64 encoded signature"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := verifyManifestSignature(test.keys, test.manifest, test.signature)
+			switch {
+			case test.wantErr == "" && err != nil:
+				t.Errorf("unexpected error: %v", err)
+			case test.wantErr != "" && (err == nil || !strings.Contains(err.Error(), test.wantErr)):
+				t.Errorf("error = %v, want one containing %q", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestDataStileManifestReadSignature(t *testing.T) {
+	encodedKey, privateKey := testSigningKey(t)
+
+	fake := newFakeBuildkite(t)
+	signed := fake.addBuild(1)
+	fake.addArtifact(signed, testManifestName, testManifest)
+	fake.addArtifact(signed, testManifestName+".sig", signManifest(privateKey, testManifest))
+	tampered := fake.addBuild(2)
+	fake.addArtifact(tampered, testManifestName, testManifest)
+	fake.addArtifact(tampered, testManifestName+".sig", signManifest(privateKey, testFallbackManifest))
+	unsigned := fake.addBuild(3)
+	fake.addArtifact(unsigned, testManifestName, testManifest)
+	fake.addBuild(4)
+
+	config := map[string]interface{}{"manifest_public_keys": []interface{}{encodedKey}}
+	p := testProviderWithConfig(t, fake, config)
+	config["require_signed_manifests"] = true
+	strict := testProviderWithConfig(t, fake, config)
+
+	d, diags := readDataSource(t, p, "stile_manifest", map[string]interface{}{
+		"manifest_name":    testManifestName,
+		"bfp_build_number": 1,
+		"verify_signature": true,
+	})
+	requireNoErrors(t, diags)
+	if !d.Get("signature_verified").(bool) {
+		t.Error("signature_verified = false, want true")
+	}
+
+	// Without verify_signature the signature isn't looked at.
+	d, diags = readDataSource(t, p, "stile_manifest", map[string]interface{}{
+		"manifest_name":    testManifestName,
+		"bfp_build_number": 3,
+	})
+	requireNoErrors(t, diags)
+	if d.Get("signature_verified").(bool) {
+		t.Error("signature_verified = true for a manifest that wasn't verified")
+	}
+
+	tests := []struct {
+		name     string
+		provider string
+		raw      map[string]interface{}
+		want     string
+	}{
+		{
+			name: "tampered",
+			raw: map[string]interface{}{
+				"bfp_build_number": 2,
+				"verify_signature": true,
+			},
+			want: "Manifest untested-prober-service-manifest.json for build 2 in test-org/test-pipeline failed signature verification",
+		},
+		{
+			name: "missing signature",
+			raw: map[string]interface{}{
+				"bfp_build_number": 3,
+				"verify_signature": true,
+			},
+			want: "Signature untested-prober-service-manifest.json.sig for manifest untested-prober-service-manifest.json not found for build 3 in test-org/test-pipeline",
+		},
+		{
+			name:     "missing signature with require_signed_manifests",
+			provider: "strict",
+			raw: map[string]interface{}{
+				"bfp_build_number": 3,
+			},
+			want: "Signature untested-prober-service-manifest.json.sig for manifest untested-prober-service-manifest.json not found for build 3 in test-org/test-pipeline",
+		},
+		{
+			name:     "fallback with require_signed_manifests",
+			provider: "strict",
+			raw: map[string]interface{}{
+				"bfp_build_number":  4,
+				"fallback_manifest": testFallbackManifest,
+			},
+			want: "Can't use manifest untested-prober-service-manifest.json from the inline manifest",
+		},
+		{
+			name: "fallback with verify_signature",
+			raw: map[string]interface{}{
+				"bfp_build_number":  4,
+				"fallback_manifest": testFallbackManifest,
+				"verify_signature":  true,
+			},
+			want: "Can't use manifest untested-prober-service-manifest.json from the inline manifest",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			provider := p
+			if test.provider == "strict" {
+				provider = strict
+			}
+			test.raw["manifest_name"] = testManifestName
+
+			_, diags := readDataSource(t, provider, "stile_manifest", test.raw)
+			requireError(t, diags, test.want)
+		})
+	}
+}